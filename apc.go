@@ -1,8 +1,10 @@
 package apc
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -13,29 +15,224 @@ import (
 
 	tlsPatched "github.com/L11R/apc-tls"
 	"github.com/L11R/go-apc/pool"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
 	"golang.org/x/text/encoding"
 )
 
 type Options struct {
-	Timeout       *time.Duration
-	LogLevel      LogLevel
-	LogHandler    LogHandler
-	Decoder       *encoding.Decoder
-	TlsPatched    bool
-	TlsSkipVerify bool
+	Timeout        *time.Duration
+	CommandTimeout *time.Duration
+	LogLevel       LogLevel
+	LogHandler     LogHandler
+	Decoder        *encoding.Decoder
+	Encoder        *encoding.Encoder
+	TlsPatched     bool
+	TlsSkipVerify  bool
+	// TlsConfig and TlsPatchedConfig are base TLS configs shared between clients
+	TlsConfig        *tls.Config
+	TlsPatchedConfig *tlsPatched.Config
+	// TlsMinVersion and TlsMaxVersion bound TLS versions of both TLS packages; zero keeps the package default
+	TlsMinVersion uint16
+	TlsMaxVersion uint16
+	// ClientCertPEM and ClientKeyPEM are the client certificate for mutual TLS
+	ClientCertPEM []byte
+	ClientKeyPEM  []byte
+	// RootCAs is used to verify the server certificate
+	RootCAs *x509.CertPool
+	// WriteTimeout bounds writing of every command; nil means only the command context bounds it
+	WriteTimeout *time.Duration
+	// WriteBuffer is the size of the buffer that coalesces frames of concurrent commands; zero disables it
+	WriteBuffer int
+	// KeepaliveInterval is the idle period after which a no-op command is sent; nil disables keepalive
+	KeepaliveInterval *time.Duration
+	// IdleTimeout closes the connection when nothing is received for the period; nil disables it
+	IdleTimeout *time.Duration
+	// TracerProvider is used to trace commands; nil means no tracing
+	TracerProvider trace.TracerProvider
+	// RetryPolicy of idempotent commands; zero value means no retries
+	RetryPolicy RetryPolicy
+	// Metrics receives metrics of commands and notifications; nil means no metrics
+	Metrics Collector
+	// GracefulLogoffTimeout bounds the logoff sequence sent by Stop; nil disables it
+	GracefulLogoffTimeout *time.Duration
+	// ServerShutdownLogoffTimeout bounds the logoff sequence sent on server shutdown; nil disables it
+	ServerShutdownLogoffTimeout *time.Duration
+	// NotificationBuffer is the capacity of the notification channel, 128 by default
+	NotificationBuffer int
+	// NotificationOverflow is the policy applied when the notification channel is full, the oldest one is dropped by default
+	NotificationOverflow NotificationOverflow
+	// RawEventHandler receives every decoded event; nil disables it
+	RawEventHandler func(Event)
+	// WireLog receives raw frames of both directions; nil disables it
+	WireLog io.Writer
+	// MaxDecodeErrors is the number of undecodable events in a row after which the connection is closed, 5 by default
+	MaxDecodeErrors int
+	// MaxConcurrentCommands is the number of commands in flight at once, others wait in a queue; 0 means no limit
+	MaxConcurrentCommands int
+	// EventBuffer is the capacity of the channel between reading of events and the Start loop, 0 by default
+	EventBuffer int
+	// Dialer establishes the raw TCP connection wrapped in TLS; nil means net.Dial
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	// FieldCacheTTL is how long values read by ReadField are cached; zero disables the cache
+	FieldCacheTTL time.Duration
+	// FieldChanges enables Notification.Changed of call notifications
+	FieldChanges bool
+	// HandshakeTimeout bounds waiting for AGTSTART banner after dialing, 5 seconds by default
+	HandshakeTimeout time.Duration
+	// ProtocolVersion of the server, zero means it's detected from AGTSTART banner if possible
+	ProtocolVersion ProtocolVersion
 }
 
 type Option func(*Options)
 
-// WithTimeout returns an Option with Timeout for underlying Client connection.
+// WithTimeout returns an Option with Timeout for underlying Client connection: it's the read deadline of every event,
+// if a whole event isn't received in time, the connection is closed along with all commands and Start() returns
+// ErrReadError. A quiet connection times out as well, so prefer WithIdleTimeout as the liveness check of the server.
+// To bound commands themselves use WithCommandTimeout, a timed out command fails alone and the connection is kept.
 func WithTimeout(timeout time.Duration) Option {
 	return func(options *Options) {
 		options.Timeout = &timeout
 	}
 }
 
+// WithIdleTimeout returns an Option with the recommended liveness check of the server: if nothing at all is received
+// for the timeout, the connection is closed along with all commands and Start() returns ErrIdleTimeout.
+// Every received byte resets it, so a long event that comes in pieces doesn't trip it; along with WithKeepalive
+// with a shorter interval a healthy connection is never idle.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(options *Options) {
+		options.IdleTimeout = &timeout
+	}
+}
+
+// WithHandshakeTimeout returns an Option that bounds waiting for AGTSTART banner, including the TLS handshake,
+// 5 seconds by default: a server that accepts the connection but never greets the client can't hang Connect.
+// On expiry the connection is closed and Connect returns ErrHelloNotReceived.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(options *Options) {
+		options.HandshakeTimeout = timeout
+	}
+}
+
+// WithProtocolVersion returns an Option with the version of Agent API spoken by the server, commands are encoded
+// accordingly (see ProtocolVersion). AGTSTART banner usually doesn't tell the version, so it's unknown without
+// the option and commands are encoded the way that every server accepts.
+func WithProtocolVersion(version ProtocolVersion) Option {
+	return func(options *Options) {
+		options.ProtocolVersion = version
+	}
+}
+
+// WithCommandTimeout returns an Option with default Timeout for every command.
+// It's applied only when the passed context has no deadline, so a silently dropped response can't hang a command forever.
+func WithCommandTimeout(timeout time.Duration) Option {
+	return func(options *Options) {
+		options.CommandTimeout = &timeout
+	}
+}
+
+// WithMaxConcurrentCommands returns an Option that limits the number of commands in flight at once,
+// since the server handles only a few requests of an agent at a time. The rest of commands wait for their turn
+// until their context is done; waiting counts against the command timeout too (see WithCommandTimeout).
+func WithMaxConcurrentCommands(n int) Option {
+	return func(options *Options) {
+		options.MaxConcurrentCommands = n
+	}
+}
+
+// WithWriteTimeout returns an Option with Timeout for writing of every command, so a server that stops reading
+// can't hang a command. A timed out write shuts the connection down: Start() returns an error wrapping ErrWriteTimeout.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(options *Options) {
+		options.WriteTimeout = &timeout
+	}
+}
+
+// WithWriteBuffer returns an Option with the buffer of the given size in front of the connection.
+// Without it, every command is written to the connection by itself. With it, frames of commands issued concurrently
+// (e.g. by ReadFields) are coalesced into fewer writes: a command leaves its frame in the buffer while other commands
+// wait to be written, and the last of them flushes the frames of all. Sequential commands gain nothing, each of them
+// is flushed before its response is awaited. 4096 bytes, the maximum command size, is a reasonable size.
+func WithWriteBuffer(size int) Option {
+	return func(options *Options) {
+		options.WriteBuffer = size
+	}
+}
+
+// WithKeepalive returns an Option that makes Client send AGTListState, a harmless query, when no commands
+// have been sent for the interval; otherwise idle agent connections could be dropped by APC server.
+// Keepalive commands go through the same request path as any other command.
+func WithKeepalive(interval time.Duration) Option {
+	return func(options *Options) {
+		options.KeepaliveInterval = &interval
+	}
+}
+
+// WithTracerProvider returns an Option with OpenTelemetry TracerProvider;
+// every command is traced as a client span, which is a child of a span from the passed context.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(options *Options) {
+		options.TracerProvider = tp
+	}
+}
+
+// WithMetrics returns an Option with Collector of command and notification metrics,
+// see the prometheus subpackage for a ready-made one.
+func WithMetrics(collector Collector) Option {
+	return func(options *Options) {
+		options.Metrics = collector
+	}
+}
+
+// RetryPolicy describes retries of idempotent commands (lists, reads and state queries) failed with transient errors.
+// State-mutating commands like FinishedItem are never retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts including the first one
+	MaxAttempts int
+	// Backoff is the delay before the first retry, it's doubled for every next one
+	Backoff time.Duration
+	// Codes of APCError considered transient, e.g. E28866
+	Codes []string
+}
+
+// retryable says whether the error is the transient one.
+func (p RetryPolicy) retryable(err error) bool {
+	for _, code := range p.Codes {
+		if errors.Is(err, APCError{Code: code}) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WithCommandRetry returns an Option with RetryPolicy of idempotent commands.
+func WithCommandRetry(policy RetryPolicy) Option {
+	return func(options *Options) {
+		options.RetryPolicy = policy
+	}
+}
+
+// zapField converts the log entry field, values of common fields (see LogFieldKeyword) are converted
+// without reflection.
+func zapField(key string, value interface{}) zap.Field {
+	switch v := value.(type) {
+	case string:
+		return zap.String(key, v)
+	case uint32:
+		return zap.Uint32(key, v)
+	case int:
+		return zap.Int(key, v)
+	case error:
+		return zap.NamedError(key, v)
+	default:
+		return zap.Any(key, value)
+	}
+}
+
 // WithLogger returns an Option with zap logger (JSON).
 func WithLogger() Option {
 	return func(options *Options) {
@@ -45,7 +242,7 @@ func WithLogger() Option {
 		options.LogHandler = func(entry LogEntry) {
 			fields := make([]zap.Field, 0, len(entry.Fields))
 			for k, v := range entry.Fields {
-				fields = append(fields, zap.Any(k, v))
+				fields = append(fields, zapField(k, v))
 			}
 
 			switch entry.Level {
@@ -70,13 +267,31 @@ func WithLogHandler(logLevel LogLevel, handler LogHandler) Option {
 }
 
 // WithDecoder returns an Option with custom decoder
-// e.g w/ charmap.Windows1251.NewDecoder().
+// e.g w/ charmap.Windows1251.NewDecoder(). Every frame is decoded as a whole once it's received completely,
+// so a rune of a multibyte encoding split between reads is decoded correctly; ReadFieldRaw still returns
+// field values as they are received.
 func WithDecoder(decoder *encoding.Decoder) Option {
 	return func(options *Options) {
 		options.Decoder = decoder
 	}
 }
 
+// WithEncoder returns an Option with custom encoder of commands, the counterpart of WithDecoder
+// e.g w/ charmap.Windows1251.NewEncoder().
+func WithEncoder(encoder *encoding.Encoder) Option {
+	return func(options *Options) {
+		options.Encoder = encoder
+	}
+}
+
+// WithDialer returns an Option with a custom dialer of the raw TCP connection, e.g. through a SOCKS5 proxy;
+// the returned connection is wrapped in TLS the same way as the one dialed by default.
+func WithDialer(dialer func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(options *Options) {
+		options.Dialer = dialer
+	}
+}
+
 // WithTlsPatched returns an Option with patched TLS package to fix issues with old TLS 1.0 only Avaya server
 func WithTlsPatched() Option {
 	return func(options *Options) {
@@ -91,16 +306,196 @@ func WithTlsSkipVerify() Option {
 	}
 }
 
+// WithTlsConfig returns an Option with base TLS config, e.g. to share one ClientSessionCache across many clients.
+// The config is cloned by every client, so it's safe to pass the same config to concurrently created clients
+// as long as it isn't modified afterwards; ClientSessionCache implementations must be safe for concurrent use.
+func WithTlsConfig(config *tls.Config) Option {
+	return func(options *Options) {
+		options.TlsConfig = config
+	}
+}
+
+// WithTlsPatchedConfig returns an Option with base config for patched TLS package, see WithTlsConfig and WithTlsPatched.
+func WithTlsPatchedConfig(config *tlsPatched.Config) Option {
+	return func(options *Options) {
+		options.TlsPatched = true
+		options.TlsPatchedConfig = config
+	}
+}
+
+// WithTlsVersion returns an Option with the range of TLS versions, e.g. tls.VersionTLS12 for both of them
+// to make sure newer APC servers aren't talked to with TLS 1.0. Zero keeps the default of the TLS package:
+// TLSv1 is the minimum of the patched one (see WithTlsPatched) and TLS 1.2 of the standard one.
+// NewClient returns an error if min is above max.
+func WithTlsVersion(min, max uint16) Option {
+	return func(options *Options) {
+		options.TlsMinVersion = min
+		options.TlsMaxVersion = max
+	}
+}
+
+// WithClientCertificate returns an Option with PEM encoded client certificate and its key
+// for APC servers that require mutual TLS; NewClient returns an error if they can't be loaded.
+func WithClientCertificate(certPEM, keyPEM []byte) Option {
+	return func(options *Options) {
+		options.ClientCertPEM = certPEM
+		options.ClientKeyPEM = keyPEM
+	}
+}
+
+// WithRootCAs returns an Option with root certificate authorities to verify the server certificate
+// instead of the system ones.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(options *Options) {
+		options.RootCAs = pool
+	}
+}
+
+// WithGracefulLogoff returns an Option that makes Stop() unwind the agent session before closing the connection:
+// AGTNoFurtherWork, AGTDetachJob, AGTDisconnHeadset, AGTFreeHeadset and finally AGTLogoff.
+// Each step is best-effort and the whole sequence is bounded by the timeout, so an unresponsive server can't hang Stop().
+func WithGracefulLogoff(timeout time.Duration) Option {
+	return func(options *Options) {
+		options.GracefulLogoffTimeout = &timeout
+	}
+}
+
+// WithServerShutdownLogoff returns an Option that unwinds the agent session the same way as WithGracefulLogoff does
+// once the server tells it's shutting down (see NotificationTypeServerShutdown). As usual, successful AGTLogoff
+// closes the connection; otherwise the client keeps rejecting new commands until it's stopped.
+func WithServerShutdownLogoff(timeout time.Duration) Option {
+	return func(options *Options) {
+		options.ServerShutdownLogoffTimeout = &timeout
+	}
+}
+
+// WithEventBuffer returns an Option with the capacity of the channel of decoded events passed to the Start loop.
+// Events are read from the connection only as fast as the Start loop takes them, and the loop itself waits
+// for commands to take their responses; once the buffer is full, the connection isn't read anymore, so the server
+// could time the client out. A bigger buffer absorbs bursts of events (e.g. notifications or long list responses),
+// while notifications themselves are buffered separately, see WithNotificationBuffer.
+func WithEventBuffer(n int) Option {
+	return func(options *Options) {
+		options.EventBuffer = n
+	}
+}
+
+// WithNotificationBuffer returns an Option with the capacity of the channel returned by Notifications().
+func WithNotificationBuffer(n int) Option {
+	return func(options *Options) {
+		options.NotificationBuffer = n
+	}
+}
+
+// WithFieldCache returns an Option that caches values read by ReadField and ReadFields for the ttl,
+// so UIs can read the same fields repeatedly without hitting the server each time. Cached values belong
+// to the current customer record only: the cache is dropped as soon as the next call notification or preview
+// arrives or the record is finished, and a field is dropped when it's updated by UpdateField.
+// Fields updated by other means (e.g. by the dialer) are stale until the ttl is over.
+func WithFieldCache(ttl time.Duration) Option {
+	return func(options *Options) {
+		options.FieldCacheTTL = ttl
+	}
+}
+
+// WithFieldChanges returns an Option that makes every call notification list fields changed since the previous one
+// in Notification.Changed, e.g. to refresh only them on the screen. The first call notification lists all the fields.
+func WithFieldChanges() Option {
+	return func(options *Options) {
+		options.FieldChanges = true
+	}
+}
+
+// WithNotificationOverflow returns an Option with the policy applied when the notification channel is full,
+// NotificationOverflowDropOldest by default. Whatever the policy is, a slow notification reader never holds back
+// responses to commands.
+func WithNotificationOverflow(policy NotificationOverflow) Option {
+	return func(options *Options) {
+		options.NotificationOverflow = policy
+	}
+}
+
+// WithRawEventHandler returns an Option with the handler that receives every decoded event,
+// e.g. to handle protocol extensions the library doesn't model yet.
+// The handler is called from its own goroutine, so it never blocks the main event loop;
+// events that don't fit into its buffer while the handler is busy are dropped.
+func WithRawEventHandler(handler func(Event)) Option {
+	return func(options *Options) {
+		options.RawEventHandler = handler
+	}
+}
+
+// WithWireLog returns an Option with the writer that receives every sent command and every received event frame
+// as they are on the wire (after WithDecoder if any); the stream could be decoded back by ReplayReader.
+// Writes are serialized, and a slow writer slows down the client.
+func WithWireLog(w io.Writer) Option {
+	return func(options *Options) {
+		options.WireLog = w
+	}
+}
+
+// WithMaxDecodeErrors returns an Option with the number of undecodable events in a row after which
+// the connection is considered desynchronized: Start() returns ErrTooManyDecodeErrors and the caller should reconnect.
+func WithMaxDecodeErrors(n int) Option {
+	return func(options *Options) {
+		options.MaxDecodeErrors = n
+	}
+}
+
 const (
 	// ConnOK means that connection is currently online
 	ConnOK uint32 = iota
 	// ConnClosed means that connection is currently closing or already closed
 	ConnClosed
+	// ConnDraining means that connection waits for in-flight commands before closing, see StopAndDrain
+	ConnDraining
 )
 
 var (
 	ErrConnectionClosed = errors.New("connection closed")
+	// ErrStoppedByUser, ErrServerClosed and ErrReadError are causes wrapped along with ErrConnectionClosed
+	// to tell why the connection has been closed, see Start.
+	ErrStoppedByUser    = errors.New("stopped by user")
+	ErrServerClosed     = errors.New("closed by server")
+	ErrReadError        = errors.New("read error")
 	ErrHelloNotReceived = errors.New("hello not received")
+	// ErrIdleTimeout is the cause wrapped along with ErrConnectionClosed when nothing has been received
+	// for the idle timeout, see WithIdleTimeout
+	ErrIdleTimeout = errors.New("idle timeout")
+	// ErrNotConnected means that the client has been created by New, but Connect hasn't succeeded
+	ErrNotConnected = errors.New("not connected")
+	// ErrIncompleteResponse means that a command has completed before the continuation of an incomplete message arrived
+	ErrIncompleteResponse = errors.New("incomplete response")
+	ErrInvalidWorkClass   = errors.New("invalid work class")
+	ErrNoCall             = errors.New("no call")
+	// ErrInvalidListType means that the list type is neither ListTypeOutbound nor ListTypeInbound
+	ErrInvalidListType = errors.New("invalid list type")
+	// ErrNotManaged means that the agent isn't working on a Managed Dialing job
+	ErrNotManaged = errors.New("not a managed dialing job")
+	// ErrNotPreviewing means that the agent has no customer record to preview
+	ErrNotPreviewing = errors.New("not previewing a record")
+	// ErrHeadsetAlreadyReserved means that the client has already reserved another headset
+	ErrHeadsetAlreadyReserved = errors.New("another headset is already reserved")
+	// ErrHeadsetNotReserved means that the headset must be reserved first
+	ErrHeadsetNotReserved = errors.New("headset is not reserved")
+	// ErrHeadsetConnected means that the headset must be disconnected first
+	ErrHeadsetConnected = errors.New("headset is connected")
+	// ErrPendingWork means that the agent can't log off while a job is attached, see LogoffOpts
+	ErrPendingWork = errors.New("pending work")
+	// ErrWriteTimeout means that a command couldn't be written in time, see WithWriteTimeout
+	ErrWriteTimeout = errors.New("write timeout")
+	// ErrTooManyDecodeErrors means that events couldn't be decoded several times in a row, see WithMaxDecodeErrors
+	ErrTooManyDecodeErrors = errors.New("too many decode errors")
+	// ErrFieldNotFound means that a field is missing from Fields
+	ErrFieldNotFound = errors.New("field not found")
+	// ErrInvalidCredentials means that the agent name or the password is empty
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrMessageTooLong means that the message doesn't fit the supervisor screen line, see MaxMessageLength
+	ErrMessageTooLong = errors.New("message is too long")
+	// ErrUnknownAgent means that SessionPool has no session of the agent
+	ErrUnknownAgent = errors.New("unknown agent")
+	// ErrSessionOpen means that AgentSession must be closed before it's opened again
+	ErrSessionOpen = errors.New("session is already open")
 )
 
 // request is the private struct that represents a request to an APC server
@@ -108,27 +503,114 @@ type request struct {
 	// context and cancel func to control a cancellation process
 	context context.Context
 	cancel  context.CancelFunc
+	// abort cancels the request with the cause returned by the command, e.g. when the connection is closed
+	abort context.CancelCauseFunc
 	// each request has own event channel w/ a bunch of possible responses
 	eventChan chan Event
+
+	// keyword of the command, the time it has started and the span that traces its execution
+	keyword string
+	started time.Time
+	span    trace.Span
+	// the error that the request has been completed with
+	err error
+	// whether the request holds a slot of concurrent commands
+	slot bool
+	// whether the request is counted as in-flight, see StopAndDrain
+	inflight bool
+	// events of the command processed so far, see LastResponse
+	events []Event
+	// whether the command has been written, so the server is going to respond to it
+	written bool
+	// whether the final response has been routed to the request, it's set by the main event loop under the read lock
+	responded bool
+	// whether the command has been destroyed before its final response arrived: the request is kept
+	// to hold the invoke ID until the late response is dropped, see destroyCommand
+	abandoned bool
 }
 
+// fail stores the error that the request has been completed with and returns it.
+func (r *request) fail(err error) error {
+	r.err = err
+	return err
+}
+
+// Client is safe for concurrent use: commands could be executed from many goroutines at once.
+// Every command gets own invoke ID, so responses are routed to the command they belong to;
+// commands are written to the connection whole, one at a time. Note that Agent API itself is stateful,
+// so the order of dependent commands (e.g. Logon before AttachJob) is still up to the caller.
 type Client struct {
-	opts   *Options
-	logger *logger
+	opts    *Options
+	logger  *logger
+	tracer  trace.Tracer
+	metrics Collector
 
 	// Stores a current state of an underlying connection, e.g. ConnOK or ConnClosed
 	state *atomic.Uint32
 
+	// server identification from AGTSTART banner and the protocol version commands are encoded for
+	serverInfo      ServerInfo
+	protocolVersion ProtocolVersion
+
+	// address of the server and the func that wraps the dialed connection in TLS, see Connect
+	addr    string
+	wrapTLS func(net.Conn) net.Conn
+	// whether Connect has been called and whether it has succeeded
+	connecting *atomic.Bool
+	connected  *atomic.Bool
+
 	// underlying connection
 	conn net.Conn
-	// decoder to deal with old encodings like Windows-1251
-	decoder io.Reader
+	// a mutex to serialize writes, so frames of concurrent commands are never interleaved
+	writeMu sync.Mutex
+	// buffer of written frames, nil if it's disabled (see WithWriteBuffer), and the number of writers
+	// waiting for the write lock
+	writeBuf     *bufio.Writer
+	queuedWrites *atomic.Int32
+	// decoder to deal with old encodings like Windows-1251, frames are decoded one by one to keep their raw bytes
+	decoder *encoding.Decoder
 	// channel w/ decoded events that were received from a connection
 	events chan Event
-	// dedicated channel for notification events only
-	notifications chan Notification
+	// subscribers of notifications, see Subscribe
+	subscribersMu sync.Mutex
+	subscribers   map[*subscriber]struct{}
+	// recorder of raw frames, nil if there is no wire log
+	wireLog *wireLog
+	// events for RawEventHandler, nil if there is no handler
+	rawEvents chan Event
+
 	// channel to shut down the *Client when the time will come
 	shutdown chan error
+	// channel that is closed by Stop() to ask the main event loop to exit
+	stop     chan struct{}
+	stopOnce sync.Once
+	// whether the main event loop has been started, or Stop has closed the connection instead
+	started *atomic.Bool
+	// channel that is closed when the main event loop has exited and the error it has exited with
+	done chan struct{}
+	err  error
+
+	// time of the last written command in unix nanoseconds, it's used by keepalive
+	lastCommand *atomic.Int64
+	// slots of concurrent commands, nil means no limit (see WithMaxConcurrentCommands)
+	commandSlots chan struct{}
+	// commands in flight, they are counted only while commands are accepted
+	inflight sync.WaitGroup
+	// events of the most recently finished command, see LastResponse
+	lastResponse   []Event
+	lastResponseMu sync.Mutex
+
+	// work class successfully set by SetWorkClass, zero if it hasn't been set
+	workClass *atomic.Uint32
+	// cache of fields of the current record, nil if it's disabled (see WithFieldCache)
+	fieldCache *fieldCache
+	// echo mode of the agent binary, it's on by default
+	echo *atomic.Bool
+	// headset state and ID of the reserved headset
+	headset   *atomic.Uint32
+	headsetID *atomic.Int64
+	// whether the agent is available for work on the attached job, see Avail and Unavail
+	available *atomic.Bool
 
 	// a pool of invoke ids that are used by requests map
 	//
@@ -142,9 +624,25 @@ type Client struct {
 	mu sync.RWMutex
 }
 
-// NewClient returns Avaya Proactive Client Agent API client to work with.
+// NewClient returns Avaya Proactive Client Agent API client to work with, it's connected already (see New and Connect).
 // Client keeps alive underlying connection, because APC proto is stateful.
+// The addr is host:port, where the host is a name, an IPv4 address or an IPv6 address in brackets.
 func NewClient(addr string, opts ...Option) (*Client, error) {
+	c, err := New(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Connect(context.Background()); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// New returns Avaya Proactive Client Agent API client without connecting it: the address and options are validated,
+// while the server is dialed later by Connect. The addr is the same as of NewClient.
+func New(addr string, opts ...Option) (*Client, error) {
 	options := &Options{}
 
 	// Apply passed opts
@@ -152,199 +650,931 @@ func NewClient(addr string, opts ...Option) (*Client, error) {
 		opt(options)
 	}
 
-	// Initiate the TCP connection to an APC server
-	conn, err := net.Dial("tcp", addr)
+	// Address must have a port, IPv6 literals are enclosed in brackets, e.g. [::1]:22700
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, fmt.Errorf("error while dialing: %w", err)
+		return nil, fmt.Errorf("invalid address %q, want host:port: %w", addr, err)
+	}
+	if port == "" {
+		return nil, fmt.Errorf("invalid address %q, want host:port: missing port", addr)
 	}
 
-	// Use patched tls package (w/ disabled BEAST attack mitigation) to wrap the TCP connection;
-	// Otherwise old APC server has random disconnects after a dozen of consistent writes.
-	var tlsConn net.Conn
-	if options.TlsPatched {
-		tlsConn = tlsPatched.Client(conn, &tlsPatched.Config{
-			AvayaCompatibility: true,
-			InsecureSkipVerify: options.TlsSkipVerify,
-			MinVersion:         tls.VersionTLS10,
-		})
-	} else {
-		tlsConn = tls.Client(conn, &tls.Config{
-			InsecureSkipVerify: options.TlsSkipVerify,
-		})
+	wrapTLS, err := newTLSWrapper(options, host)
+	if err != nil {
+		return nil, err
 	}
 
 	c := &Client{
 		opts:         options,
-		state:        atomic.NewUint32(ConnOK),
-		conn:         tlsConn,
-		decoder:      tlsConn,
-		events:       make(chan Event),
-		shutdown:     make(chan error),
+		addr:         addr,
+		wrapTLS:      wrapTLS,
+		state:        atomic.NewUint32(ConnClosed),
+		connecting:   atomic.NewBool(false),
+		connected:    atomic.NewBool(false),
+		events:       make(chan Event, options.EventBuffer),
+		shutdown:     make(chan error, 1),
+		stop:         make(chan struct{}),
+		started:      atomic.NewBool(false),
+		done:         make(chan struct{}),
+		lastCommand:  atomic.NewInt64(time.Now().UnixNano()),
+		queuedWrites: atomic.NewInt32(0),
+		workClass:    atomic.NewUint32(0),
+		subscribers:  make(map[*subscriber]struct{}),
+		echo:         atomic.NewBool(true),
+		headset:      atomic.NewUint32(uint32(HeadsetFree)),
+		headsetID:    atomic.NewInt64(0),
+		available:    atomic.NewBool(false),
 		invokeIDPool: pool.NewInvokeIDPool(),
 		requests:     make(map[uint32]*request),
 	}
-	if options.Decoder != nil {
-		c.decoder = options.Decoder.Reader(tlsConn)
+	if options.WireLog != nil {
+		c.wireLog = &wireLog{w: options.WireLog}
+	}
+	if options.RawEventHandler != nil {
+		c.rawEvents = make(chan Event, 128)
+	}
+	if options.FieldCacheTTL > 0 {
+		c.fieldCache = newFieldCache(options.FieldCacheTTL)
+	}
+	if options.MaxConcurrentCommands > 0 {
+		c.commandSlots = make(chan struct{}, options.MaxConcurrentCommands)
 	}
 	if options.LogHandler != nil {
 		c.logger = newLogger(options.LogLevel, options.LogHandler)
 	}
 
+	tp := options.TracerProvider
+	if tp == nil {
+		tp = noop.NewTracerProvider()
+	}
+	c.tracer = tp.Tracer("github.com/L11R/go-apc")
+
+	c.metrics = options.Metrics
+	if c.metrics == nil {
+		c.metrics = nopCollector{}
+	}
+
+	return c, nil
+}
+
+// newTLSWrapper returns the func that wraps the TCP connection in TLS according to options.
+func newTLSWrapper(options *Options, host string) (func(net.Conn) net.Conn, error) {
+	if options.TlsMinVersion != 0 && options.TlsMaxVersion != 0 && options.TlsMinVersion > options.TlsMaxVersion {
+		return nil, fmt.Errorf("invalid TLS versions: min %#04x is above max %#04x", options.TlsMinVersion, options.TlsMaxVersion)
+	}
+
+	// Use patched tls package (w/ disabled BEAST attack mitigation) to wrap the TCP connection;
+	// Otherwise old APC server has random disconnects after a dozen of consistent writes.
+	if options.TlsPatched {
+		config := &tlsPatched.Config{
+			MinVersion: tls.VersionTLS10,
+		}
+		if options.TlsPatchedConfig != nil {
+			config = options.TlsPatchedConfig.Clone()
+		}
+		config.AvayaCompatibility = true
+		if options.TlsMinVersion != 0 {
+			config.MinVersion = options.TlsMinVersion
+		}
+		if options.TlsMaxVersion != 0 {
+			config.MaxVersion = options.TlsMaxVersion
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		if options.TlsSkipVerify {
+			config.InsecureSkipVerify = true
+		}
+		if options.RootCAs != nil {
+			config.RootCAs = options.RootCAs
+		}
+		if options.ClientCertPEM != nil {
+			cert, err := tlsPatched.X509KeyPair(options.ClientCertPEM, options.ClientKeyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("cannot load client certificate: %w", err)
+			}
+			config.Certificates = append(config.Certificates, cert)
+		}
+
+		return func(conn net.Conn) net.Conn {
+			return tlsPatched.Client(conn, config)
+		}, nil
+	}
+
+	config := &tls.Config{}
+	if options.TlsConfig != nil {
+		config = options.TlsConfig.Clone()
+	}
+	if options.TlsMinVersion != 0 {
+		config.MinVersion = options.TlsMinVersion
+	}
+	if options.TlsMaxVersion != 0 {
+		config.MaxVersion = options.TlsMaxVersion
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if options.TlsSkipVerify {
+		config.InsecureSkipVerify = true
+	}
+	if options.RootCAs != nil {
+		config.RootCAs = options.RootCAs
+	}
+	if options.ClientCertPEM != nil {
+		cert, err := tls.X509KeyPair(options.ClientCertPEM, options.ClientKeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	return func(conn net.Conn) net.Conn {
+		return tls.Client(conn, config)
+	}, nil
+}
+
+// defaultHandshakeTimeout bounds waiting for AGTSTART banner if WithHandshakeTimeout isn't set.
+const defaultHandshakeTimeout = 5 * time.Second
+
+// Connect dials the server and waits for its AGTSTART banner, ctx bounds both of them;
+// the banner is also bounded by the handshake timeout (see WithHandshakeTimeout).
+// The client could be connected once only, create a new one if Connect has failed.
+func (c *Client) Connect(ctx context.Context) error {
+	if !c.connecting.CompareAndSwap(false, true) {
+		return fmt.Errorf("client has already been connected")
+	}
+
+	// Initiate the TCP connection to an APC server
+	dial := c.opts.Dialer
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", c.addr)
+	if err != nil {
+		return fmt.Errorf("error while dialing: %w", err)
+	}
+
+	tlsConn := c.wrapTLS(conn)
+	c.conn = tlsConn
+	if c.opts.WriteBuffer > 0 {
+		c.writeBuf = bufio.NewWriterSize(tlsConn, c.opts.WriteBuffer)
+	}
+	c.decoder = c.opts.Decoder
+
 	// Goroutine that starts event reading from the connection
 	go func() {
 		c.shutdown <- c.readEvents()
 	}()
 
-	// Read the first AGTSTART event before returning the *Client
-	event := <-c.events
+	// Read the first AGTSTART event before the client could be used
+	handshakeTimeout := c.opts.HandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = defaultHandshakeTimeout
+	}
+	timer := time.NewTimer(handshakeTimeout)
+	defer timer.Stop()
+
+	var event Event
+	select {
+	case event = <-c.events:
+	case <-timer.C:
+		_ = c.conn.Close()
+		return fmt.Errorf("cannot receive hello in %v: %w", handshakeTimeout, ErrHelloNotReceived)
+	case err := <-c.shutdown:
+		_ = c.conn.Close()
+		return fmt.Errorf("cannot receive hello: %w", err)
+	case <-ctx.Done():
+		_ = c.conn.Close()
+		return fmt.Errorf("cannot receive hello: %w", ctx.Err())
+	}
 
 	// Check that the first notification message is correct
-	if event.Keyword != "AGTSTART" ||
-		!event.IsStart() {
+	info, err := serverInfo(event)
+	if err != nil {
 		c.logger.log(newLogEntry(LogLevelError, "Server cannot accept new clients!"))
-		return nil, ErrHelloNotReceived
+		_ = c.conn.Close()
+		return err
+	}
+	c.serverInfo = info
+	c.protocolVersion = c.opts.ProtocolVersion
+	if c.protocolVersion.IsZero() {
+		c.protocolVersion = protocolVersionOf(info)
 	}
 
-	return c, nil
+	// Notifications has own request inside request map, but it has fake invoke ID to avoid conflicts with real ones.
+	// Real invoke IDs are limited to 4 digits (9999), while MaxUint32 is 4294967295.
+	// The request lives as long as the connection, notifications are delivered to subscribers if any.
+	r := newRequest(context.Background(), nil)
+	c.mu.Lock()
+	c.requests[math.MaxUint32] = r
+	c.mu.Unlock()
+	publish := c.publish
+	if c.opts.FieldChanges {
+		publish = (&fieldChanges{publish: c.publish}).track
+	}
+	go processNotifications(r, publish, c.metrics)
+
+	c.state.Store(ConnOK)
+	c.connected.Store(true)
+
+	return nil
+}
+
+// DebugStats is the snapshot of commands in flight and of the invoke ID pool, see Client.DebugStats.
+type DebugStats struct {
+	// InFlight is the number of commands holding an invoke ID, including the ones waiting for a slot
+	InFlight int
+	// Abandoned is the number of timed out or cancelled commands whose invoke IDs are held
+	// until their late responses arrive or the connection is closed
+	Abandoned int
+	// InvokeIDs is the largest invoke ID in the pool, FreeInvokeIDs of them are released and wait for reuse;
+	// InvokeIDs minus FreeInvokeIDs growing over time means invoke IDs leak
+	InvokeIDs     int
+	FreeInvokeIDs int
+}
+
+// DebugStats returns the current number of commands in flight and the state of the invoke ID pool,
+// e.g. to diagnose the pool exhaustion; every allocation and release is also logged at LogLevelDebug.
+func (c *Client) DebugStats() DebugStats {
+	var stats DebugStats
+
+	c.mu.RLock()
+	for invokeID, r := range c.requests {
+		switch {
+		// Notifications have their own request that lives as long as the connection
+		case invokeID == math.MaxUint32:
+		case r.abandoned:
+			stats.Abandoned++
+		default:
+			stats.InFlight++
+		}
+	}
+	c.mu.RUnlock()
+
+	maxUsed, recycled := c.invokeIDPool.Stats()
+	stats.InvokeIDs = int(maxUsed)
+	stats.FreeInvokeIDs = recycled
+
+	return stats
+}
+
+// ServerInfo returns identification of the server sent in AGTSTART banner.
+func (c *Client) ServerInfo() ServerInfo {
+	return c.serverInfo
+}
+
+// ProtocolVersion returns the version of Agent API commands are encoded for, either set by WithProtocolVersion
+// or detected from AGTSTART banner; it's zero if the version is unknown or the client isn't connected.
+func (c *Client) ProtocolVersion() ProtocolVersion {
+	return c.protocolVersion
+}
+
+// SessionID returns the identity of the session taken from AGTSTART banner, it stays the same for the whole connection.
+// It's zero if the client isn't connected.
+func (c *Client) SessionID() SessionID {
+	if !c.connected.Load() {
+		return SessionID{}
+	}
+
+	return SessionID{Server: c.serverInfo.Name, ProcessID: c.serverInfo.ProcessID}
+}
+
+// RemoteAddr returns the address of the server.
+// It's nil if the client isn't connected.
+func (c *Client) RemoteAddr() net.Addr {
+	if !c.connected.Load() {
+		return nil
+	}
+
+	return c.conn.RemoteAddr()
+}
+
+// ConnectionInfo describes the TLS session negotiated with the server.
+type ConnectionInfo struct {
+	// Version is the TLS version, e.g. tls.VersionTLS10
+	Version uint16
+	// CipherSuite is the cipher suite ID, its name is returned by tls.CipherSuiteName
+	CipherSuite uint16
 }
 
-// Start starts main event loop handler.
+// ConnectionInfo returns the negotiated TLS session, either of the standard or of the patched TLS connection;
+// it's zero if the client isn't connected.
+func (c *Client) ConnectionInfo() ConnectionInfo {
+	if !c.connected.Load() {
+		return ConnectionInfo{}
+	}
+
+	switch conn := c.conn.(type) {
+	case *tls.Conn:
+		state := conn.ConnectionState()
+		return ConnectionInfo{Version: state.Version, CipherSuite: state.CipherSuite}
+	case *tlsPatched.Conn:
+		state := conn.ConnectionState()
+		return ConnectionInfo{Version: state.Version, CipherSuite: state.CipherSuite}
+	}
+
+	return ConnectionInfo{}
+}
+
+// Start starts main event loop handler. It returns nil once the client is stopped by Stop or by successful logoff,
+// otherwise the error is ErrConnectionClosed wrapped along with the cause: ErrServerClosed if the server has closed
+// the connection, ErrReadError with the error itself if reading has failed, ErrIdleTimeout, ErrTooManyDecodeErrors
+// or ErrWriteTimeout.
+// Commands interrupted by closing fail with the same error, or with ErrStoppedByUser if the client has been stopped.
 func (c *Client) Start() error {
+	if !c.connected.Load() {
+		return ErrNotConnected
+	}
+	// The loop runs once: the client could have been stopped before Start or it's already running
+	if !c.started.CompareAndSwap(false, true) {
+		<-c.done
+		return c.err
+	}
+
+	if c.opts.KeepaliveInterval != nil {
+		go c.keepalive(*c.opts.KeepaliveInterval)
+	}
+	if c.rawEvents != nil {
+		go c.handleRawEvents(c.opts.RawEventHandler)
+	}
+
 	for {
 		// Wait for events, error or an execution of Stop()
 		select {
 		case event := <-c.events:
+			// Pass the event to the raw event handler without waiting for it
+			if c.rawEvents != nil {
+				select {
+				case c.rawEvents <- event:
+				default:
+					c.logger.log(newLogEntry(LogLevelError, "Raw event handler is busy, dropping event!", map[string]interface{}{LogFieldKeyword: event.Keyword}))
+				}
+			}
+
 			// Assign notification events own invoke IDs to get them processed
 			if event.Type == EventTypeNotification {
 				event.InvokeID = math.MaxUint32
 			}
 
-			// Look up for a request
+			// Look up for a request; the final response is marked under the lock, so destroyCommand knows
+			// whether a late one is still to come
 			c.mu.RLock()
 			r, ok := c.requests[event.InvokeID]
+			// Responses carry the keyword of the command, a mismatch is the late event of another command
+			// (e.g. after reconnecting); it isn't expected otherwise, since invoke IDs of timed out commands
+			// aren't reused until their late responses arrive
+			if ok && r.keyword != "" && event.Keyword != r.keyword {
+				c.logger.log(newLogEntry(LogLevelInfo, "Late event of another command, dropping it.", map[string]interface{}{LogFieldKeyword: event.Keyword, LogFieldInvokeID: event.InvokeID}))
+				ok = false
+			}
+			abandoned := ok && r.abandoned
+			if ok && event.Type == EventTypeResponse {
+				r.responded = true
+			}
 			c.mu.RUnlock()
 
-			// In case of success, send received event into own request event channel
+			// The late response of the abandoned command releases its invoke ID at last
+			if abandoned {
+				if event.Type == EventTypeResponse {
+					c.releaseAbandoned(event.InvokeID, r)
+				}
+				ok = false
+			}
+
+			// In case of success, send received event into own request event channel;
+			// a request that has already given up doesn't read it anymore, so don't get stuck on it
 			if ok {
-				r.eventChan <- event
+				select {
+				case r.eventChan <- event:
+				case <-r.context.Done():
+				}
 			}
 		case err := <-c.shutdown:
-			// In case of shutting down mark connection as closed...
-			c.state.Store(ConnClosed)
+			return c.close(err)
+		case <-c.stop:
+			return c.close(nil)
+		}
+	}
+}
+
+// StopAndDrain stops the client gracefully: new commands are rejected with ErrConnectionClosed right away,
+// while commands in flight are waited for until ctx is done; then the client is stopped as by Stop.
+// It returns the ctx error if commands haven't completed in time, the connection is closed anyway.
+func (c *Client) StopAndDrain(ctx context.Context) error {
+	// The state is switched under the requests lock, so no command could be counted after that
+	c.mu.Lock()
+	draining := c.state.CompareAndSwap(ConnOK, ConnDraining)
+	c.mu.Unlock()
+
+	var err error
+	if draining {
+		drained := make(chan struct{})
+		go func() {
+			c.inflight.Wait()
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = fmt.Errorf("cannot drain commands: %w", ctx.Err())
+		}
+	}
+
+	c.Stop()
+
+	return err
+}
+
+// Stop stops main event loop handler and closes the underlying connection.
+// It is safe to call Stop several times, and even before Start: then the connection is closed right away
+// and Start returns nil when it's called after that. Stop never waits for the main event loop, only the graceful
+// logoff if it's enabled (see WithGracefulLogoff) takes time; use StopContext to wait for the loop.
+func (c *Client) Stop() {
+	c.requestStop(context.Background())
+}
+
+// StopContext stops the client as Stop does, then waits until the main event loop exits.
+// Both the graceful logoff and the waiting are bounded by ctx; it returns the ctx error if the loop hasn't exited
+// in time. A client that hasn't been started is closed right away, as by Stop.
+func (c *Client) StopContext(ctx context.Context) error {
+	c.requestStop(ctx)
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("main event loop hasn't exited: %w", ctx.Err())
+	}
+}
+
+// requestStop runs the graceful logoff if it's enabled and asks the main event loop to exit.
+func (c *Client) requestStop(ctx context.Context) {
+	// Without the main event loop nothing would close the connection, so it's closed here, and no commands
+	// of the graceful logoff could complete either
+	if c.connected.Load() && c.started.CompareAndSwap(false, true) {
+		c.stopOnce.Do(func() {
+			close(c.stop)
+		})
+		_ = c.close(nil)
+		return
+	}
+
+	if state := c.state.Load(); c.opts.GracefulLogoffTimeout != nil && (state == ConnOK || state == ConnDraining) {
+		ctx, cancel := context.WithTimeout(ctx, *c.opts.GracefulLogoffTimeout)
+		c.gracefulLogoff(ctx)
+		cancel()
+	}
+
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// logoffKey marks the context of the graceful logoff: its commands are accepted while the client is draining,
+// while commands of the application are rejected.
+type logoffKey struct{}
+
+// gracefulLogoff unwinds the agent session in the reverse order of its setup.
+// Errors are only logged: the agent may not have a job attached or a headset reserved at all.
+func (c *Client) gracefulLogoff(ctx context.Context) {
+	ctx = context.WithValue(ctx, logoffKey{}, true)
+
+	steps := []struct {
+		keyword string
+		fn      func(context.Context) error
+	}{
+		{"AGTNoFurtherWork", c.NoFurtherWork},
+		{"AGTDetachJob", c.DetachJob},
+		{"AGTDisconnHeadset", c.DisconnectHeadset},
+		{"AGTFreeHeadset", c.FreeHeadset},
+		{"AGTLogoff", c.Logoff},
+	}
+	for _, step := range steps {
+		if err := step.fn(ctx); err != nil {
+			c.logger.log(newLogEntry(LogLevelInfo, "Graceful logoff step has failed.", map[string]interface{}{LogFieldKeyword: step.keyword, LogFieldError: err}))
 
-			// Close it...
-			if err := c.conn.Close(); err != nil {
-				return err
+			// Don't bother with the rest steps if the time is over or the connection is gone
+			if ctx.Err() != nil || errors.Is(err, ErrConnectionClosed) {
+				return
 			}
+		}
+	}
+}
+
+// serverShutdown switches the client to ConnDraining, so new commands are rejected with ErrConnectionClosed
+// before subscribers learn about the shutdown, and starts the logoff sequence if it's enabled.
+func (c *Client) serverShutdown() {
+	c.mu.Lock()
+	draining := c.state.CompareAndSwap(ConnOK, ConnDraining)
+	c.mu.Unlock()
+
+	if !draining || c.opts.ServerShutdownLogoffTimeout == nil {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), *c.opts.ServerShutdownLogoffTimeout)
+		c.gracefulLogoff(ctx)
+		cancel()
+	}()
+}
 
-			// Close notifications channel...
-			if c.notifications != nil {
-				close(c.notifications)
+// keepalive sends a no-op command every time the connection has been idle for the interval.
+func (c *Client) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// There is no need in keepalive while commands are flowing
+			if time.Since(time.Unix(0, c.lastCommand.Load())) < interval {
+				continue
 			}
 
-			// Close global events channel...
-			close(c.events)
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if _, err := c.ListState(ctx); err != nil {
+				c.logger.log(newLogEntry(LogLevelDebug, "Keepalive has failed.", map[string]interface{}{LogFieldError: err}))
+			}
+			cancel()
+		case <-c.done:
+			return
+		}
+	}
+}
 
-			// And finally send done signal to all active requests.
-			func() {
-				c.mu.RLock()
-				defer c.mu.RUnlock()
-				for _, r := range c.requests {
-					r.cancel()
-				}
-			}()
+// handleRawEvents calls the handler for every event passed by the main event loop until it exits.
+func (c *Client) handleRawEvents(handler func(Event)) {
+	for {
+		select {
+		case event := <-c.rawEvents:
+			handler(event)
+		case <-c.done:
+			return
+		}
+	}
+}
 
-			return err
+func (c *Client) close(err error) error {
+	// In case of shutting down mark connection as closed...
+	c.state.Store(ConnClosed)
+
+	// Close it...
+	if closeErr := c.conn.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	// The reason of closing is wrapped along with ErrConnectionClosed, e.g. ErrTooManyDecodeErrors
+	if err != nil && !errors.Is(err, ErrConnectionClosed) {
+		err = fmt.Errorf("%w: %w", ErrConnectionClosed, err)
+	}
+
+	// Send done signal to all active requests along with the reason of closing.
+	cause := err
+	if cause == nil {
+		cause = fmt.Errorf("%w: %w", ErrConnectionClosed, ErrStoppedByUser)
+	}
+	c.mu.RLock()
+	for _, r := range c.requests {
+		r.abort(cause)
+	}
+	c.mu.RUnlock()
+
+	// Late responses won't arrive anymore
+	c.mu.Lock()
+	for invokeID, r := range c.requests {
+		if r.abandoned {
+			delete(c.requests, invokeID)
+			c.releaseInvokeID(invokeID, r.keyword)
 		}
 	}
+	c.mu.Unlock()
+
+	// And finally remember the terminal error and signal that the main event loop has exited.
+	c.err = err
+	close(c.done)
+
+	return err
+}
+
+// Done returns a channel that is closed when the main event loop started by Start() exits for any reason.
+// It's safe to call Done before Start.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait blocks until the main event loop exits and returns the same error as Start() does.
+func (c *Client) Wait() error {
+	<-c.done
+	return c.err
 }
 
 // Notifications returns read-only notification event channel.
+// The channel is closed when ctx is done or the connection is closed.
 func (c *Client) Notifications(ctx context.Context) <-chan Notification {
-	c.notifications = make(chan Notification, 128)
+	notifications, _ := c.Subscribe(ctx)
+	return notifications
+}
 
-	// Notifications has own request...
-	r := newRequest(ctx)
+// Subscribe returns an independent channel that receives a copy of every notification and the func to unsubscribe.
+// The channel is closed on unsubscribe, when ctx is done or the connection is closed.
+// Every subscriber has own buffer, see WithNotificationBuffer and WithNotificationOverflow.
+func (c *Client) Subscribe(ctx context.Context) (<-chan Notification, func()) {
+	buffer := c.NotificationQueueCap()
 
-	// ...inside request map, but it has fake invoke ID to avoid conflicts with real ones.
-	// Real invoke IDs are limited to 4 digits (9999), while MaxUint32 is 4294967295.
-	c.mu.Lock()
-	c.requests[math.MaxUint32] = r
-	c.mu.Unlock()
+	s := &subscriber{
+		in:    make(chan Notification, buffer),
+		queue: newNotificationQueue(make(chan Notification, buffer), c.opts.NotificationOverflow, c.logger),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	c.subscribersMu.Lock()
+	c.subscribers[s] = struct{}{}
+	c.subscribersMu.Unlock()
 
 	go func() {
-		// Don't forget to delete it from map to avoid deadlock while notifications are not in use
 		defer func() {
-			c.mu.Lock()
-			delete(c.requests, math.MaxUint32)
-			c.mu.Unlock()
+			c.subscribersMu.Lock()
+			delete(c.subscribers, s)
+			c.subscribersMu.Unlock()
 		}()
 
-		processNotifications(r, c.notifications)
+		s.run(ctx, c.done)
+	}()
+
+	return s.queue.ch, s.unsubscribe
+}
+
+// OnNotification registers the handler of notifications of the given type and returns the func to unregister it.
+// Every handler runs in own goroutine with own buffer (see WithNotificationBuffer), so a slow handler doesn't hold up
+// handlers of other types. Notifications of all types share the buffer, so once a slow handler fills it,
+// WithNotificationOverflow policy applies: by default the oldest notifications are dropped, and with
+// NotificationOverflowUnbounded they pile up in memory until the handler catches up.
+// The handler isn't called after the connection is closed, but a call in progress could still run
+// when the func to unregister returns.
+func (c *Client) OnNotification(notificationType NotificationType, handler func(Notification)) func() {
+	notifications, unsubscribe := c.Subscribe(context.Background())
+
+	go func() {
+		for n := range notifications {
+			if n.Type == notificationType {
+				handler(n)
+			}
+		}
 	}()
 
-	return c.notifications
+	return unsubscribe
+}
+
+// NotificationQueueLen returns the number of notifications waiting in the channel of the most lagging subscriber,
+// 0 if there are no subscribers. Once it reaches NotificationQueueCap, the subscriber falls behind the server
+// and WithNotificationOverflow policy applies to the rest.
+func (c *Client) NotificationQueueLen() int {
+	c.subscribersMu.Lock()
+	defer c.subscribersMu.Unlock()
+
+	var n int
+	for s := range c.subscribers {
+		if l := len(s.queue.ch); l > n {
+			n = l
+		}
+	}
+
+	return n
+}
+
+// NotificationQueueCap returns the capacity of the channel of every subscriber, see WithNotificationBuffer.
+func (c *Client) NotificationQueueCap() int {
+	if c.opts.NotificationBuffer <= 0 {
+		return 128
+	}
+
+	return c.opts.NotificationBuffer
+}
+
+// publish delivers the notification to all subscribers.
+func (c *Client) publish(n Notification) {
+	if n.Type == NotificationTypeServerShutdown {
+		c.serverShutdown()
+	}
+	// The broken headset has to be connected again
+	if n.Type == NotificationTypeHeadsetConnBroken {
+		c.headset.CompareAndSwap(uint32(HeadsetConnected), uint32(HeadsetReserved))
+	}
+	// Fields of the previous record must not be read from the cache once the next one is delivered
+	if c.fieldCache != nil && (n.Type == NotificationTypeCallNotify || n.Type == NotificationTypePreviewRecord) {
+		c.fieldCache.next()
+	}
+
+	c.subscribersMu.Lock()
+	defer c.subscribersMu.Unlock()
+
+	for s := range c.subscribers {
+		select {
+		case s.in <- n:
+		case <-s.done:
+		}
+	}
+}
+
+// subscriber is the own notification queue of every Subscribe call.
+type subscriber struct {
+	// notifications published to the subscriber
+	in    chan Notification
+	queue *notificationQueue
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// run moves published notifications into the queue until the subscriber is stopped.
+func (s *subscriber) run(ctx context.Context, closed <-chan struct{}) {
+	defer close(s.queue.ch)
+	defer close(s.done)
+
+	for {
+		select {
+		case n := <-s.in:
+			s.queue.push(n)
+		case s.queue.out() <- s.queue.next():
+			s.queue.pending = s.queue.pending[1:]
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (s *subscriber) unsubscribe() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// idleReader records the time of the last read of any bytes, see watchIdle.
+type idleReader struct {
+	r        io.Reader
+	lastRead *atomic.Int64
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.lastRead.Store(time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// watchIdle closes the connection once nothing has been read for the timeout, so the blocked read fails;
+// it returns when stop is closed.
+func (c *Client) watchIdle(timeout time.Duration, lastRead *atomic.Int64, idle *atomic.Bool, stop <-chan struct{}) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if elapsed := time.Since(time.Unix(0, lastRead.Load())); elapsed < timeout {
+				timer.Reset(timeout - elapsed)
+				continue
+			}
+
+			idle.Store(true)
+			_ = c.conn.Close()
+			return
+		case <-stop:
+			return
+		}
+	}
 }
 
 func (c *Client) readEvents() error {
+	blocks := make(blockMerger)
+
+	// Any received byte counts as activity for the idle timeout
+	var reader io.Reader = c.conn
+	idle := atomic.NewBool(false)
+	if c.opts.IdleTimeout != nil {
+		lastRead := atomic.NewInt64(time.Now().UnixNano())
+		reader = idleReader{r: c.conn, lastRead: lastRead}
+
+		stopIdle := make(chan struct{})
+		defer close(stopIdle)
+		go c.watchIdle(*c.opts.IdleTimeout, lastRead, idle, stopIdle)
+	}
+
+	// Frames are read as they are and then decoded one by one if there is a decoder to avoid encoding problems
+	// (to activate it use WithDecoder()); for example in Russia APC server uses Windows-1251.
+	frames := newFrameReader(reader)
+
+	maxDecodeErrors := c.opts.MaxDecodeErrors
+	if maxDecodeErrors <= 0 {
+		maxDecodeErrors = 5
+	}
+	var decodeErrors int
+
 	// Main event loop.
 	for {
 		// Set actual
 		if c.opts.Timeout != nil {
 			if err := c.conn.SetReadDeadline(time.Now().Add(*c.opts.Timeout)); err != nil {
-				c.logger.log(newLogEntry(LogLevelError, "Error while setting a deadline!", map[string]interface{}{"error": err}))
-				return err
+				c.logger.log(newLogEntry(LogLevelError, "Error while setting a deadline!", map[string]interface{}{LogFieldError: err}))
+				return fmt.Errorf("%w: %w: %w", ErrConnectionClosed, ErrReadError, err)
 			}
 		}
 
-		// 4096 bytes is the maximum request size, but 256 should be enough;
-		// could be increased in case of getting errors.
-		buf := make([]byte, 256)
-
-		// Without decoder, it will use c.tlsConn directly; read through decoder to avoid encoding problems
-		// (to activate it use WithDecoder()); for example in Russia APC server uses Windows-1251.
-		n, err := c.decoder.Read(buf)
+		frame, err := frames.next()
+		receivedAt := time.Now()
 		if err != nil {
+			if idle.Load() {
+				c.logger.log(newLogEntry(LogLevelError, "Nothing has received for the idle timeout!", map[string]interface{}{LogFieldError: err}))
+				return fmt.Errorf("%w: %w", ErrConnectionClosed, ErrIdleTimeout)
+			}
 			if err == io.EOF {
-				c.logger.log(newLogEntry(LogLevelInfo, "EOF received.", map[string]interface{}{"error": err}))
-				return ErrConnectionClosed
+				c.logger.log(newLogEntry(LogLevelInfo, "EOF received.", map[string]interface{}{LogFieldError: err}))
+				return fmt.Errorf("%w: %w", ErrConnectionClosed, ErrServerClosed)
 			}
 
-			c.logger.log(newLogEntry(LogLevelError, "Error received!", map[string]interface{}{"error": err}))
-			return err
+			c.logger.log(newLogEntry(LogLevelError, "Error received!", map[string]interface{}{LogFieldError: err}))
+			return fmt.Errorf("%w: %w: %w", ErrConnectionClosed, ErrReadError, err)
+		}
+		rawEvent := frame
+		if c.decoder != nil {
+			if rawEvent, err = c.decoder.String(frame); err != nil {
+				c.logger.log(newLogEntry(LogLevelError, "Error received!", map[string]interface{}{LogFieldError: err}))
+				return fmt.Errorf("%w: %w: %w", ErrConnectionClosed, ErrReadError, err)
+			}
+		}
+		// Fields of frequent entries are built only when they are logged at all
+		if c.logger.enabled(LogLevelDebug) {
+			c.logger.log(newLogEntry(LogLevelDebug, "Event has received.", map[string]interface{}{LogFieldRaw: rawEvent}))
 		}
+		c.wireLog.write([]byte(rawEvent))
 
-		// If the last byte of read buffer is ETX or ETB, then start event decoding
-		if buf[n-1] == ETX || buf[n-1] == ETB {
-			rawEvent := string(buf[:n])
-			c.logger.log(newLogEntry(LogLevelDebug, "Event has received.", map[string]interface{}{"raw": rawEvent}))
+		// A broken frame is skipped up to its terminator, so the next one is decoded from its beginning
+		event, err := DecodeEvent(rawEvent)
+		if err != nil {
+			decodeErrors++
+			c.metrics.DecodeFailed()
+			c.logger.log(newLogEntry(LogLevelError, "Error while decoding an event!", map[string]interface{}{LogFieldError: err, "errors_in_row": decodeErrors}))
 
-			event, err := decodeEvent(rawEvent)
-			if err != nil {
-				c.logger.log(newLogEntry(LogLevelError, "Error while decoding an event!", map[string]interface{}{"error": err}))
-				return err
+			if decodeErrors >= maxDecodeErrors {
+				return ErrTooManyDecodeErrors
 			}
+			continue
+		}
+		decodeErrors = 0
+		event.ReceivedAt = receivedAt
+
+		// Raw segments are split the same way, delimiters are ASCII in any encoding the server could use
+		if c.decoder != nil {
+			if raw, err := DecodeEvent(frame); err == nil && len(raw.Segments) == len(event.Segments) {
+				event.rawSegments = make([][]byte, len(raw.Segments))
+				for i, segment := range raw.Segments {
+					event.rawSegments[i] = []byte(segment)
+				}
+			}
+		}
 
+		if c.logger.enabled(LogLevelInfo) {
 			c.logger.log(newLogEntry(
 				LogLevelInfo,
 				"Event has decoded.",
 				map[string]interface{}{
-					"keyword":    event.Keyword,
-					"type":       string(event.Type),
-					"client":     event.Client,
-					"process_id": event.ProcessID,
-					"invoke_id":  event.InvokeID,
-					"segments":   event.Segments,
-					"incomplete": event.IsIncomplete,
+					LogFieldKeyword:  event.Keyword,
+					"type":           string(event.Type),
+					"client":         event.Client,
+					"process_id":     event.ProcessID,
+					LogFieldInvokeID: event.InvokeID,
+					"segments":       event.Segments,
+					"incomplete":     event.IsIncomplete,
 				},
 			))
+		}
 
-			c.events <- event
-
-			// In case of successful logoff just break the read loop
-			if event.IsSuccessfulResponse() && event.Keyword == "AGTLogoff" {
-				break
+		// Blocks of an incomplete message are passed on as a single event
+		var loggedOff bool
+		for _, event := range blocks.merge(event) {
+			// Don't get stuck on sending if the main event loop has already exited
+			select {
+			case c.events <- event:
+			case <-c.stop:
+				return ErrConnectionClosed
 			}
+
+			loggedOff = event.IsSuccessfulResponse() && event.Keyword == "AGTLogoff"
+		}
+
+		// In case of successful logoff just break the read loop
+		if loggedOff {
+			break
 		}
 	}
 
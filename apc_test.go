@@ -0,0 +1,1346 @@
+package apc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestClient_Stop(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, done := newTestClient(t, s)
+
+	c.Stop()
+
+	if err := waitStart(t, done); err != nil {
+		t.Errorf("Start() error = %v, want nil", err)
+	}
+
+	if got := s.keywords(); len(got) != 0 {
+		t.Errorf("server received %v, want nothing", got)
+	}
+}
+
+func TestClient_Stop_GracefulLogoff(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, done := newTestClient(t, s, WithGracefulLogoff(time.Second))
+
+	c.Stop()
+
+	if err := waitStart(t, done); err != nil {
+		t.Errorf("Start() error = %v, want nil", err)
+	}
+
+	want := []string{"AGTNoFurtherWork", "AGTDetachJob", "AGTDisconnHeadset", "AGTFreeHeadset", "AGTLogoff"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_Stop_GracefulLogoffUnresponsive(t *testing.T) {
+	// Server never answers
+	s := newMockServer(t, nil)
+	c, done := newTestClient(t, s, WithGracefulLogoff(100*time.Millisecond))
+
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop() hangs on unresponsive server")
+	}
+
+	if err := waitStart(t, done); err != nil {
+		t.Errorf("Start() error = %v, want nil", err)
+	}
+}
+
+func TestClient_Stop_BeforeStart(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, err := NewClient(s.addr(), WithTlsSkipVerify())
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop() hangs before Start()")
+	}
+
+	// The main event loop isn't running, so the connection is closed by Stop itself
+	if got := c.state.Load(); got != ConnClosed {
+		t.Errorf("state = %v after Stop(), want closed", got)
+	}
+	if _, err := c.conn.Write([]byte{0}); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("connection Write() error = %v, want %v", err, net.ErrClosed)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Error("Done() isn't closed after Stop()")
+	}
+
+	if err := c.Start(); err != nil {
+		t.Errorf("Start() error = %v after Stop(), want nil", err)
+	}
+	if err := c.StopContext(context.Background()); err != nil {
+		t.Errorf("StopContext() error = %v after Start() has returned", err)
+	}
+}
+
+func TestClient_StopContext(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, done := newTestClient(t, s, WithGracefulLogoff(time.Second))
+
+	if err := c.StopContext(context.Background()); err != nil {
+		t.Fatalf("StopContext() error = %v", err)
+	}
+
+	// The main event loop has already exited
+	select {
+	case <-c.Done():
+	default:
+		t.Error("StopContext() has returned before the main event loop exited")
+	}
+	if err := waitStart(t, done); err != nil {
+		t.Errorf("Start() error = %v, want nil", err)
+	}
+}
+
+func TestNewClient_SharedTlsConfig(t *testing.T) {
+	s := newMockServer(t, respondOK)
+
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(8),
+	}
+
+	c1, _ := newTestClient(t, s, WithTlsConfig(config))
+	c2, _ := newTestClient(t, s, WithTlsConfig(config))
+
+	if c1.conn.(*tls.Conn).ConnectionState().DidResume {
+		t.Error("first client resumed TLS session, want full handshake")
+	}
+	if !c2.conn.(*tls.Conn).ConnectionState().DidResume {
+		t.Error("second client didn't resume TLS session from the shared cache")
+	}
+
+	for _, c := range []*Client{c1, c2} {
+		if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+			t.Errorf("Logon() error = %v", err)
+		}
+	}
+}
+
+func TestClient_Keepalive(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	_, _ = newTestClient(t, s, WithKeepalive(50*time.Millisecond))
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, keyword := range s.keywords() {
+			if keyword == "AGTListState" {
+				return
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("server received %v, want AGTListState keepalive", s.keywords())
+}
+
+func TestNewClient_ClientCertificate(t *testing.T) {
+	serverCert, serverCertPEM, _ := newTestCertificate(t)
+	_, clientCertPEM, clientKeyPEM := newTestCertificate(t)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCertPEM)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AppendCertsFromPEM(serverCertPEM)
+
+	s := newMockServerWithConfig(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}, respondOK)
+
+	t.Run("Valid", func(t *testing.T) {
+		c, err := NewClient(s.addr(), WithRootCAs(rootCAs), WithClientCertificate(clientCertPEM, clientKeyPEM))
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		go c.Start()
+		defer c.Stop()
+
+		if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+			t.Errorf("Logon() error = %v", err)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		if _, err := NewClient(s.addr(), WithRootCAs(rootCAs)); err == nil {
+			t.Error("NewClient() error = nil, want handshake error")
+		}
+	})
+
+	t.Run("Unknown server", func(t *testing.T) {
+		_, err := NewClient(s.addr(), WithClientCertificate(clientCertPEM, clientKeyPEM))
+
+		var unknownAuthority x509.UnknownAuthorityError
+		if !errors.As(err, &unknownAuthority) {
+			t.Errorf("NewClient() error = %v, want unknown authority", err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := NewClient(s.addr(), WithClientCertificate(clientCertPEM, []byte("garbage")))
+		if err == nil || !strings.Contains(err.Error(), "cannot load client certificate") {
+			t.Errorf("NewClient() error = %v, want cannot load client certificate", err)
+		}
+	})
+}
+
+func TestClient_ServerInfo(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	if got := c.ServerInfo(); got.Name != "Agent server" || got.ProcessID != 1539 || got.Message != "AGENT_STARTUP" {
+		t.Errorf("ServerInfo() = %#v, want Agent server 1539 AGENT_STARTUP", got)
+	}
+}
+
+func TestClient_SessionID(t *testing.T) {
+	s := newMockServer(t, respondOK)
+
+	c, err := New(s.addr(), WithTlsSkipVerify())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if got := c.SessionID(); got != (SessionID{}) {
+		t.Errorf("SessionID() = %v before Connect, want zero", got)
+	}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	go c.Start()
+	t.Cleanup(c.Stop)
+
+	want := SessionID{Server: "Agent server", ProcessID: 1539}
+	if got := c.SessionID(); got != want {
+		t.Errorf("SessionID() = %v, want %v", got, want)
+	}
+	if got := want.String(); got != "Agent server/1539" {
+		t.Errorf("String() = %q, want %q", got, "Agent server/1539")
+	}
+
+	// Responses come from the same agent binary
+	if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+		t.Fatalf("Logon() error = %v", err)
+	}
+	for _, event := range c.LastResponse() {
+		if got := (SessionID{Server: event.Client, ProcessID: event.ProcessID}); got != c.SessionID() {
+			t.Errorf("response of session %v, want %v", got, c.SessionID())
+		}
+	}
+}
+
+func TestClient_Notifications_StalledReader(t *testing.T) {
+	const count = 10
+
+	codes := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		codes = append(codes, fmt.Sprintf("E0000%d", i))
+	}
+
+	tests := []struct {
+		name   string
+		policy NotificationOverflow
+		want   []string
+	}{
+		{"Unbounded", NotificationOverflowUnbounded, codes},
+		{"DropNewest", NotificationOverflowDropNewest, codes[:1]},
+		{"DropOldest", NotificationOverflowDropOldest, codes[count-1:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMockServer(t, func(conn *mockConn, cmd Event) {
+				// Flood the client with notifications before the response
+				for _, code := range codes {
+					conn.send("AGTSystemError", EventTypeNotification, 0, "1", code)
+				}
+				respondOK(conn, cmd)
+			})
+			c, _ := newTestClient(t, s, WithNotificationBuffer(1), WithNotificationOverflow(tt.policy), WithCommandTimeout(time.Second))
+
+			notifications := c.Notifications(context.Background())
+
+			// Nobody reads notifications, yet the response must flow
+			if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+				t.Fatalf("Logon() error = %v", err)
+			}
+			// Let the last notifications reach the queue
+			time.Sleep(100 * time.Millisecond)
+
+			var got []string
+			for {
+				select {
+				case n := <-notifications:
+					got = append(got, n.Payload.(string))
+					continue
+				case <-time.After(200 * time.Millisecond):
+				}
+				break
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("received %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_Done(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, err := NewClient(s.addr(), WithTlsSkipVerify())
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	// Done is safe to use before Start
+	select {
+	case <-c.Done():
+		t.Fatal("Done() is closed before Start()")
+	default:
+	}
+
+	go c.Start()
+	c.Stop()
+
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done() is not closed after Stop()")
+	}
+
+	if err := c.Wait(); err != nil {
+		t.Errorf("Wait() error = %v, want nil", err)
+	}
+}
+
+func TestClient_Start_Causes(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		// terminate closes the connection one way or another
+		terminate func(c *Client, s *mockServer)
+		// startErr is the cause of the Start error, nil means no error
+		startErr error
+		// commandErr is the cause of the error of the interrupted command
+		commandErr error
+	}{
+		{"Stop", nil, func(c *Client, s *mockServer) { c.Stop() }, nil, ErrStoppedByUser},
+		{"ServerClosed", nil, func(c *Client, s *mockServer) { s.close() }, ErrServerClosed, ErrServerClosed},
+		{"ReadError", []Option{WithTimeout(100 * time.Millisecond)}, func(c *Client, s *mockServer) {}, ErrReadError, ErrReadError},
+		{"IdleTimeout", []Option{WithIdleTimeout(100 * time.Millisecond)}, func(c *Client, s *mockServer) {}, ErrIdleTimeout, ErrIdleTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Server never answers
+			s := newMockServer(t, nil)
+			c, done := newTestClient(t, s, tt.opts...)
+
+			interrupted := make(chan error, 1)
+			go func() {
+				interrupted <- c.AttachJob(context.Background(), "TEST_JOB")
+			}()
+			for len(s.keywords()) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			tt.terminate(c, s)
+
+			err := waitStart(t, done)
+			switch {
+			case tt.startErr == nil && err != nil:
+				t.Errorf("Start() error = %v, want nil", err)
+			case tt.startErr != nil && (!errors.Is(err, ErrConnectionClosed) || !errors.Is(err, tt.startErr)):
+				t.Errorf("Start() error = %v, want %v: %v", err, ErrConnectionClosed, tt.startErr)
+			}
+
+			if err := <-interrupted; !errors.Is(err, ErrConnectionClosed) || !errors.Is(err, tt.commandErr) {
+				t.Errorf("AttachJob() error = %v, want %v: %v", err, ErrConnectionClosed, tt.commandErr)
+			}
+		})
+	}
+}
+
+func TestClient_IdleTimeout_Active(t *testing.T) {
+	const idleTimeout = 100 * time.Millisecond
+
+	quiet := make(chan struct{})
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		respondOK(conn, cmd)
+
+		// The server keeps sending notifications more often than the idle timeout, then falls silent
+		go func() {
+			defer close(quiet)
+			for i := 0; i < 10; i++ {
+				time.Sleep(idleTimeout / 4)
+				conn.send("AGTJobEnd", EventTypeNotification, 0, "0", "M00000")
+			}
+		}()
+	})
+	c, done := newTestClient(t, s, WithIdleTimeout(idleTimeout))
+
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); err != nil {
+		t.Fatalf("AttachJob() error = %v", err)
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("Start() error = %v while the server is active", err)
+	case <-quiet:
+	}
+
+	if err := waitStart(t, done); !errors.Is(err, ErrConnectionClosed) || !errors.Is(err, ErrIdleTimeout) {
+		t.Errorf("Start() error = %v, want %v: %v", err, ErrConnectionClosed, ErrIdleTimeout)
+	}
+}
+
+func TestClient_IncompleteResponse(t *testing.T) {
+	var first bool
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if !first {
+			// The command completes before the continuation of the data message
+			first = true
+			conn.dataBlock(cmd, "0", "M00001", "O,outbnd1,A")
+			respondOK(conn, cmd)
+			return
+		}
+
+		conn.dataBlock(cmd, "0", "M00001", "O,outbnd1,A")
+		conn.data(cmd, "I,inbnd1,A")
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s, WithCommandTimeout(time.Second))
+
+	if _, err := c.ListJobs(context.Background(), JobTypeAll); !errors.Is(err, ErrIncompleteResponse) {
+		t.Fatalf("ListJobs() error = %v, want %v", err, ErrIncompleteResponse)
+	}
+
+	// Nothing is left of the broken message, the next one is merged as usual
+	jobs, err := c.ListJobs(context.Background(), JobTypeAll)
+	if err != nil {
+		t.Fatalf("ListJobs() error = %v", err)
+	}
+	if len(jobs) != 2 {
+		t.Errorf("ListJobs() = %+v, want 2 jobs", jobs)
+	}
+}
+
+func TestClient_Wait_ServerClosed(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, done := newTestClient(t, s)
+
+	s.close()
+
+	err := c.Wait()
+	if err == nil {
+		t.Fatal("Wait() error = nil, want read error")
+	}
+	if startErr := waitStart(t, done); startErr != err {
+		t.Errorf("Wait() error = %v, Start() error = %v, want the same", err, startErr)
+	}
+}
+
+func TestClient_RawEventHandler(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.send("AGTMadeUpEvent", EventTypeNotification, 0, "0", "M00001", "something new")
+		respondOK(conn, cmd)
+	})
+
+	events := make(chan Event, 8)
+	c, _ := newTestClient(t, s, WithRawEventHandler(func(event Event) {
+		events <- event
+	}))
+
+	if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+		t.Fatalf("Logon() error = %v", err)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Keyword != "AGTMadeUpEvent" {
+				continue
+			}
+
+			if want := []string{"0", "M00001", "something new"}; !reflect.DeepEqual(event.Segments, want) {
+				t.Errorf("event segments = %v, want %v", event.Segments, want)
+			}
+			return
+		case <-timeout:
+			t.Fatal("raw event handler hasn't received AGTMadeUpEvent")
+		}
+	}
+}
+
+func TestClient_RawEventHandler_Blocked(t *testing.T) {
+	s := newMockServer(t, respondOK)
+
+	block := make(chan struct{})
+	defer close(block)
+
+	c, _ := newTestClient(t, s, WithRawEventHandler(func(Event) {
+		<-block
+	}), WithCommandTimeout(time.Second))
+
+	// The stuck handler must not hold back responses
+	for i := 0; i < 200; i++ {
+		if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+			t.Fatalf("Logon() error = %v", err)
+		}
+	}
+}
+
+func TestClient_DecodeErrorResync(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		// A truncated frame immediately followed by a valid response within the same write
+		frame := encodeEvent(cmd.Keyword, EventTypeResponse, cmd.InvokeID, "0", "M00000")
+		_, _ = conn.Write(append([]byte("AGTLogon   R Agent\x03"), frame...))
+	})
+	c, done := newTestClient(t, s, WithCommandTimeout(time.Second))
+
+	if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+		t.Fatalf("Logon() error = %v", err)
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("Start() has returned %v after a single decode error", err)
+	default:
+	}
+}
+
+func TestClient_DecodeErrorThreshold(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		for i := 0; i < 3; i++ {
+			_, _ = conn.Write([]byte("garbage\x03"))
+		}
+	})
+	c, done := newTestClient(t, s, WithMaxDecodeErrors(3))
+
+	go c.Logon(context.Background(), "agent", "password")
+
+	if err := waitStart(t, done); !errors.Is(err, ErrConnectionClosed) || !errors.Is(err, ErrTooManyDecodeErrors) {
+		t.Errorf("Start() error = %v, want %v: %v", err, ErrConnectionClosed, ErrTooManyDecodeErrors)
+	}
+}
+
+func TestClient_Subscribe(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		respondOK(conn, cmd)
+		conn.send("AGTJobEnd", EventTypeNotification, 0, "0", "M00000")
+	})
+	c, _ := newTestClient(t, s)
+
+	first, unsubscribe := c.Subscribe(context.Background())
+	second, _ := c.Subscribe(context.Background())
+
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); err != nil {
+		t.Fatalf("AttachJob() error = %v", err)
+	}
+
+	for i, ch := range []<-chan Notification{first, second} {
+		select {
+		case n := <-ch:
+			if n.Type != NotificationTypeJobEnd {
+				t.Errorf("subscriber %d received %v, want %v", i, n.Type, NotificationTypeJobEnd)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscriber %d hasn't received the notification", i)
+		}
+	}
+
+	unsubscribe()
+	unsubscribe()
+
+	select {
+	case _, ok := <-first:
+		if ok {
+			t.Error("unsubscribed channel received a notification, want it closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel isn't closed after unsubscribe")
+	}
+
+	// The rest of subscribers keep receiving notifications
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); err != nil {
+		t.Fatalf("AttachJob() error = %v", err)
+	}
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Fatal("second subscriber hasn't received the notification after the first one unsubscribed")
+	}
+}
+
+func TestClient_NotificationQueueLen(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		respondOK(conn, cmd)
+		for i := 0; i < 3; i++ {
+			conn.send("AGTJobEnd", EventTypeNotification, 0, "0", "M00000")
+		}
+	})
+	c, _ := newTestClient(t, s, WithNotificationBuffer(8))
+
+	if got := c.NotificationQueueLen(); got != 0 {
+		t.Errorf("NotificationQueueLen() = %d without subscribers, want 0", got)
+	}
+	if got := c.NotificationQueueCap(); got != 8 {
+		t.Errorf("NotificationQueueCap() = %d, want 8", got)
+	}
+
+	// Nobody reads the channel, so notifications pile up
+	_, unsubscribe := c.Subscribe(context.Background())
+	defer unsubscribe()
+
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); err != nil {
+		t.Fatalf("AttachJob() error = %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for c.NotificationQueueLen() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("NotificationQueueLen() = %d, want 3", c.NotificationQueueLen())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient_Subscribe_ClosedOnStop(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, done := newTestClient(t, s)
+
+	notifications, _ := c.Subscribe(context.Background())
+	c.Stop()
+	_ = waitStart(t, done)
+
+	select {
+	case _, ok := <-notifications:
+		if ok {
+			t.Error("received a notification, want the channel closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel isn't closed after Stop()")
+	}
+}
+
+func TestClient_Notifications_ContextCancelled(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	notifications := c.Notifications(ctx)
+
+	exited := make(chan struct{})
+	go func() {
+		for range notifications {
+		}
+		close(exited)
+	}()
+
+	cancel()
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("consumer is still ranging over notifications after ctx is cancelled")
+	}
+
+	// The client itself keeps working
+	if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+		t.Errorf("Logon() error = %v", err)
+	}
+}
+
+func TestNewClient_Address(t *testing.T) {
+	t.Run("IPv4", func(t *testing.T) {
+		s := newMockServer(t, respondOK)
+
+		c, err := NewClient(s.addr(), WithTlsSkipVerify())
+		if err != nil {
+			t.Fatalf("NewClient() error = %v", err)
+		}
+		c.Stop()
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		cert, _, _ := newTestCertificate(t)
+		listener, err := tls.Listen("tcp", "[::1]:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			t.Skipf("IPv6 is not available: %v", err)
+		}
+
+		s := &mockServer{listener: listener, handler: respondOK}
+		go s.serve()
+		t.Cleanup(s.close)
+
+		c, err := NewClient(s.addr(), WithTlsSkipVerify())
+		if err != nil {
+			t.Fatalf("NewClient(%q) error = %v", s.addr(), err)
+		}
+		c.Stop()
+	})
+
+	for _, addr := range []string{"apc.example.com", "apc.example.com:", "::1:22700", "[::1]"} {
+		t.Run("invalid "+addr, func(t *testing.T) {
+			_, err := NewClient(addr)
+			if err == nil || !strings.Contains(err.Error(), "invalid address") {
+				t.Errorf("NewClient(%q) error = %v, want invalid address", addr, err)
+			}
+		})
+	}
+}
+
+// readerConn is the connection that reads from the reader, other methods aren't used by readEvents
+type readerConn struct {
+	net.Conn
+	io.Reader
+}
+
+func (c readerConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+func TestClient_ReadEvents_SplitRune(t *testing.T) {
+	// Every read returns a single byte, so multibyte runes are split across reads
+	frame := encodeEvent("AGTCallNotify", EventTypeData, 0, "0", "M00001", "NAME,Иван Петров", "CITY,Санкт-Петербург")
+	c := &Client{
+		opts:    &Options{},
+		conn:    readerConn{Reader: iotest.OneByteReader(bytes.NewReader(frame))},
+		decoder: unicode.UTF8.NewDecoder(),
+		events:  make(chan Event, 1),
+		stop:    make(chan struct{}),
+		logger:  newLogger(LogLevelNone, func(LogEntry) {}),
+		metrics: nopCollector{},
+	}
+
+	if err := c.readEvents(); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("readEvents() error = %v, want %v", err, ErrServerClosed)
+	}
+
+	event := <-c.events
+	if want := []string{"0", "M00001", "NAME,Иван Петров", "CITY,Санкт-Петербург"}; !reflect.DeepEqual(event.Segments, want) {
+		t.Errorf("event segments = %q, want %q", event.Segments, want)
+	}
+}
+
+func BenchmarkClient_ReadEvents(b *testing.B) {
+	frame := encodeEvent("AGTCallNotify", EventTypeData, 0, "0", "M00001", "CURPHONE,01", "NAME,John Smith", "BALANCE,1500")
+
+	for _, level := range []LogLevel{LogLevelNone, LogLevelDebug} {
+		b.Run(LogLevelToString(level), func(b *testing.B) {
+			stream := bytes.Repeat(frame, b.N)
+
+			c := &Client{
+				opts:    &Options{},
+				conn:    readerConn{Reader: bytes.NewReader(stream)},
+				events:  make(chan Event, 1),
+				stop:    make(chan struct{}),
+				logger:  newLogger(level, func(LogEntry) {}),
+				metrics: nopCollector{},
+			}
+			go func() {
+				for range c.events {
+				}
+			}()
+			defer close(c.events)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			if err := c.readEvents(); !errors.Is(err, ErrServerClosed) {
+				b.Fatalf("readEvents() error = %v, want %v", err, ErrServerClosed)
+			}
+		})
+	}
+}
+
+func TestClient_ConnectionInfo(t *testing.T) {
+	cert, _, _ := newTestCertificate(t)
+	// Old APC servers speak TLSv1 only
+	s := newMockServerWithConfig(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS10,
+		MaxVersion:   tls.VersionTLS10,
+	}, respondOK)
+
+	c, _ := newTestClient(t, s, WithTlsPatched())
+
+	if got := c.RemoteAddr().String(); got != s.addr() {
+		t.Errorf("RemoteAddr() = %s, want %s", got, s.addr())
+	}
+
+	info := c.ConnectionInfo()
+	if info.Version != tls.VersionTLS10 {
+		t.Errorf("ConnectionInfo().Version = %#04x, want TLSv1 (%#04x)", info.Version, tls.VersionTLS10)
+	}
+	if info.CipherSuite == 0 {
+		t.Error("ConnectionInfo().CipherSuite = 0, want negotiated cipher suite")
+	}
+}
+
+func TestClient_TlsVersion(t *testing.T) {
+	cert, _, _ := newTestCertificate(t)
+	s := newMockServerWithConfig(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS12,
+	}, respondOK)
+
+	for _, patched := range []bool{false, true} {
+		t.Run(fmt.Sprintf("patched=%v", patched), func(t *testing.T) {
+			opts := []Option{WithTlsVersion(tls.VersionTLS12, tls.VersionTLS12)}
+			if patched {
+				opts = append(opts, WithTlsPatched())
+			}
+			c, _ := newTestClient(t, s, opts...)
+
+			if got := c.ConnectionInfo().Version; got != tls.VersionTLS12 {
+				t.Errorf("ConnectionInfo().Version = %#04x, want TLS 1.2 (%#04x)", got, tls.VersionTLS12)
+			}
+		})
+	}
+
+	// The server doesn't speak TLS versions below 1.2
+	if _, err := NewClient(s.addr(), WithTlsSkipVerify(), WithTlsPatched(), WithTlsVersion(tls.VersionTLS10, tls.VersionTLS11)); err == nil {
+		t.Error("NewClient() error = nil, want handshake failure")
+	}
+
+	if _, err := New(s.addr(), WithTlsVersion(tls.VersionTLS13, tls.VersionTLS12)); err == nil {
+		t.Error("New() error = nil, want invalid TLS versions")
+	}
+}
+
+func TestClient_EventBuffer(t *testing.T) {
+	s := newMockServer(t, respondOK)
+
+	c, err := NewClient(s.addr(), WithTlsSkipVerify(), WithEventBuffer(64))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	t.Cleanup(c.Stop)
+
+	// Nothing takes events until Start, the whole burst must still be read from the connection
+	s.mu.Lock()
+	conn := s.conns[0]
+	s.mu.Unlock()
+	for i := 0; i < 64; i++ {
+		conn.send("AGTJobEnd", EventTypeNotification, 0, "0", "M00000")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(c.events) < 64 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of 64 events are buffered", len(c.events))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNewClient_Dialer(t *testing.T) {
+	s := newMockServer(t, respondOK)
+
+	var dialed []string
+	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+addr)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	c, _ := newTestClient(t, s, WithDialer(dialer))
+
+	if want := []string{"tcp " + s.addr()}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("dialer was called with %v, want %v", dialed, want)
+	}
+
+	// The connection is wrapped in TLS as usual
+	if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+		t.Errorf("Logon() error = %v", err)
+	}
+}
+
+func TestNewClient_DialerError(t *testing.T) {
+	dialErr := errors.New("proxy refused")
+	_, err := NewClient("127.0.0.1:22700", WithDialer(func(context.Context, string, string) (net.Conn, error) {
+		return nil, dialErr
+	}))
+	if !errors.Is(err, dialErr) {
+		t.Errorf("NewClient() error = %v, want %v", err, dialErr)
+	}
+}
+
+func TestClient_StopAndDrain(t *testing.T) {
+	release := make(chan struct{})
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if cmd.Keyword == "AGTAttachJob" {
+			<-release
+		}
+		respondOK(conn, cmd)
+	})
+	c, done := newTestClient(t, s)
+
+	inflight := make(chan error, 1)
+	go func() {
+		inflight <- c.AttachJob(context.Background(), "TEST_JOB")
+	}()
+	for len(s.keywords()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- c.StopAndDrain(context.Background())
+	}()
+	for c.state.Load() != ConnDraining {
+		time.Sleep(time.Millisecond)
+	}
+
+	// New commands are rejected while draining
+	if err := c.DetachJob(context.Background()); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("DetachJob() error = %v, want %v", err, ErrConnectionClosed)
+	}
+
+	select {
+	case <-done:
+		t.Fatal("connection is closed before the in-flight command has completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-inflight; err != nil {
+		t.Errorf("AttachJob() error = %v", err)
+	}
+	if err := <-drained; err != nil {
+		t.Errorf("StopAndDrain() error = %v", err)
+	}
+	if err := waitStart(t, done); err != nil {
+		t.Errorf("Start() error = %v", err)
+	}
+}
+
+// respondServerShutdown is the mockHandler that tells the client the server is shutting down before answering AGTLogon.
+func respondServerShutdown(conn *mockConn, cmd Event) {
+	if cmd.Keyword == "AGTLogon" {
+		conn.send("AGTSystemError", EventTypeNotification, 0, "1", "E28921")
+	}
+	respondOK(conn, cmd)
+}
+
+func TestClient_ServerShutdown(t *testing.T) {
+	s := newMockServer(t, respondServerShutdown)
+	c, _ := newTestClient(t, s)
+
+	notifications := c.Notifications(context.Background())
+	if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+		t.Fatalf("Logon() error = %v", err)
+	}
+
+	want := []Notification{
+		{Type: NotificationTypeSystemError, Payload: "E28921"},
+		{Type: NotificationTypeServerShutdown, Payload: "E28921"},
+	}
+	for _, w := range want {
+		select {
+		case n := <-notifications:
+			n.ReceivedAt = time.Time{}
+			if !reflect.DeepEqual(n, w) {
+				t.Fatalf("notification = %+v, want %+v", n, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("notification %s hasn't been delivered", w.Type)
+		}
+	}
+
+	if state := c.state.Load(); state != ConnDraining {
+		t.Errorf("state = %d, want %d", state, ConnDraining)
+	}
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("AttachJob() error = %v, want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestClient_ServerShutdown_Logoff(t *testing.T) {
+	s := newMockServer(t, respondServerShutdown)
+	c, done := newTestClient(t, s, WithServerShutdownLogoff(time.Second))
+
+	notifications := c.Notifications(context.Background())
+	if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+		t.Fatalf("Logon() error = %v", err)
+	}
+	for n := range notifications {
+		if n.Type == NotificationTypeServerShutdown {
+			break
+		}
+	}
+
+	want := []string{"AGTLogon", "AGTNoFurtherWork", "AGTDetachJob", "AGTDisconnHeadset", "AGTFreeHeadset", "AGTLogoff"}
+	deadline := time.Now().Add(time.Second)
+	for !reflect.DeepEqual(s.keywords(), want) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("server received %v, want %v", got, want)
+	}
+
+	// Successful logoff closes the connection
+	if err := waitStart(t, done); err != nil {
+		t.Errorf("Start() error = %v", err)
+	}
+}
+
+func TestClient_StopAndDrain_GracefulLogoff(t *testing.T) {
+	logoff := make(chan struct{})
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if cmd.Keyword == "AGTNoFurtherWork" {
+			close(logoff)
+			time.Sleep(100 * time.Millisecond)
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s, WithGracefulLogoff(time.Second))
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- c.StopAndDrain(context.Background())
+	}()
+
+	// Commands of the application are rejected while the logoff runs its own ones
+	<-logoff
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("AttachJob() error = %v, want %v", err, ErrConnectionClosed)
+	}
+
+	if err := <-drained; err != nil {
+		t.Errorf("StopAndDrain() error = %v", err)
+	}
+	want := []string{"AGTNoFurtherWork", "AGTDetachJob", "AGTDisconnHeadset", "AGTFreeHeadset", "AGTLogoff"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_StopAndDrain_Timeout(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {})
+	c, done := newTestClient(t, s)
+
+	inflight := make(chan error, 1)
+	go func() {
+		inflight <- c.AttachJob(context.Background(), "TEST_JOB")
+	}()
+	for len(s.keywords()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.StopAndDrain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("StopAndDrain() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The connection is torn down anyway
+	_ = waitStart(t, done)
+	if err := <-inflight; err == nil {
+		t.Error("AttachJob() error = nil after teardown")
+	}
+}
+
+func TestClient_OnNotification(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		respondOK(conn, cmd)
+		conn.send("AGTCallNotify", EventTypeNotification, 0, "0", "M00001", "0000000001", "OUTBOUND")
+		conn.send("AGTCallNotify", EventTypeNotification, 0, "0", "M00001", "CURPHONE,01")
+		conn.send("AGTCallNotify", EventTypeNotification, 0, "0", "M00000")
+		conn.send("AGTAutoReleaseLine", EventTypeNotification, 0, "0", "M00000")
+	})
+	c, _ := newTestClient(t, s)
+
+	callNotify := make(chan Notification, 2)
+	autoRelease := make(chan Notification, 2)
+	c.OnNotification(NotificationTypeCallNotify, func(n Notification) { callNotify <- n })
+	unregister := c.OnNotification(NotificationTypeAutoReleaseLine, func(n Notification) { autoRelease <- n })
+
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); err != nil {
+		t.Fatalf("AttachJob() error = %v", err)
+	}
+
+	for _, tc := range []struct {
+		ch   chan Notification
+		want NotificationType
+	}{
+		{callNotify, NotificationTypeCallNotify},
+		{autoRelease, NotificationTypeAutoReleaseLine},
+	} {
+		select {
+		case n := <-tc.ch:
+			if n.Type != tc.want {
+				t.Errorf("handler of %s got %s", tc.want, n.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("handler of %s hasn't been called", tc.want)
+		}
+	}
+
+	// The unregistered handler isn't called anymore, while the other one still is
+	unregister()
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); err != nil {
+		t.Fatalf("AttachJob() error = %v", err)
+	}
+	select {
+	case <-callNotify:
+	case <-time.After(time.Second):
+		t.Fatalf("handler of %s hasn't been called again", NotificationTypeCallNotify)
+	}
+	select {
+	case n := <-autoRelease:
+		t.Errorf("unregistered handler got %v", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Each handler got notifications of its type only
+	if len(callNotify) != 0 {
+		t.Errorf("handler of %s got %d unexpected notifications", NotificationTypeCallNotify, len(callNotify))
+	}
+}
+
+func TestClient_Connect(t *testing.T) {
+	s := newMockServer(t, respondOK)
+
+	c, err := New(s.addr(), WithTlsSkipVerify())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(c.Stop)
+
+	// Nothing is dialed until Connect
+	if err := c.Start(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Start() error = %v before Connect, want %v", err, ErrNotConnected)
+	}
+	if err := c.Logon(context.Background(), "agent", "password"); !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("Logon() error = %v before Connect, want %v", err, ErrConnectionClosed)
+	}
+	if addr := c.RemoteAddr(); addr != nil {
+		t.Errorf("RemoteAddr() = %v before Connect, want nil", addr)
+	}
+
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	if err := c.Connect(context.Background()); err == nil {
+		t.Error("Connect() error = nil on the connected client")
+	}
+	if got := c.ServerInfo().Name; got != "Agent server" {
+		t.Errorf("ServerInfo().Name = %q, want Agent server", got)
+	}
+
+	go c.Start()
+	if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+		t.Errorf("Logon() error = %v", err)
+	}
+}
+
+func TestClient_Connect_Cancelled(t *testing.T) {
+	// The server accepts connections, but never completes the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+
+	c, err := New(listener.Addr().String(), WithTlsSkipVerify())
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Connect(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Connect() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestNewClient_HandshakeTimeout(t *testing.T) {
+	// The server completes TLS handshake, but never sends AGTSTART
+	cert, _, _ := newTestCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	handshaken := make(chan error, 1)
+	closed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handshaken <- conn.(*tls.Conn).Handshake()
+
+		// The client closes the connection once the timeout is over
+		_, _ = conn.Read(make([]byte, 1))
+		close(closed)
+	}()
+
+	start := time.Now()
+	_, err = NewClient(listener.Addr().String(), WithTlsSkipVerify(), WithHandshakeTimeout(100*time.Millisecond))
+	if !errors.Is(err, ErrHelloNotReceived) {
+		t.Fatalf("NewClient() error = %v, want %v", err, ErrHelloNotReceived)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("NewClient() has returned in %v, want about the handshake timeout", elapsed)
+	}
+
+	if err := <-handshaken; err != nil {
+		t.Errorf("TLS handshake error = %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("connection has not been closed")
+	}
+}
+
+func TestClient_ReceivedAt(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		respondOK(conn, cmd)
+		conn.send("AGTCallNotify", EventTypeNotification, 0, "0", "M00001", "0000000001", "OUTBOUND")
+		conn.send("AGTCallNotify", EventTypeNotification, 0, "0", "M00001", "CURPHONE,01")
+		conn.send("AGTCallNotify", EventTypeNotification, 0, "0", "M00000")
+		conn.send("AGTAutoReleaseLine", EventTypeNotification, 0, "0", "M00000")
+	})
+	c, _ := newTestClient(t, s)
+
+	notifications := c.Notifications(context.Background())
+	start := time.Now()
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); err != nil {
+		t.Fatalf("AttachJob() error = %v", err)
+	}
+
+	// The response is stamped as well
+	response := c.LastResponse()
+	if len(response) != 1 || response[0].ReceivedAt.Before(start) {
+		t.Fatalf("LastResponse() = %+v, want the response received after the command has started", response)
+	}
+
+	prev := response[0].ReceivedAt
+	for _, want := range []NotificationType{NotificationTypeCallNotify, NotificationTypeAutoReleaseLine} {
+		select {
+		case n := <-notifications:
+			if n.Type != want {
+				t.Fatalf("notification = %s, want %s", n.Type, want)
+			}
+			if n.ReceivedAt.Before(prev) {
+				t.Errorf("%s ReceivedAt = %v, want not before %v", n.Type, n.ReceivedAt, prev)
+			}
+			prev = n.ReceivedAt
+		case <-time.After(time.Second):
+			t.Fatalf("notification %s hasn't been delivered", want)
+		}
+	}
+}
+
+func TestClient_LogHandler_TypedFields(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.respond(cmd, "1", "E28866")
+	})
+
+	var (
+		mu      sync.Mutex
+		entries = make(map[string]LogEntry)
+	)
+	c, _ := newTestClient(t, s,
+		WithCommandRetry(RetryPolicy{MaxAttempts: 2, Codes: []string{"E28866"}}),
+		WithLogHandler(LogLevelDebug, func(entry LogEntry) {
+			mu.Lock()
+			defer mu.Unlock()
+			entries[entry.Message] = entry
+		}),
+	)
+
+	if _, err := c.ListKeys(context.Background()); !errors.Is(err, APCError{Code: "E28866"}) {
+		t.Fatalf("ListKeys() error = %v, want E28866", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	sent := entries["Command has sent."]
+	if keyword, ok := sent.Keyword(); !ok || keyword != "AGTListKeys" {
+		t.Errorf("Keyword() = %q, %v, want AGTListKeys", keyword, ok)
+	}
+	if invokeID, ok := sent.InvokeID(); !ok || invokeID == 0 {
+		t.Errorf("InvokeID() = %d, %v, want invoke ID of the command", invokeID, ok)
+	}
+	if raw, ok := entries["Event has received."].Raw(); !ok || !strings.HasPrefix(raw, "AGTListKeys") {
+		t.Errorf("Raw() = %q, %v, want raw AGTListKeys event", raw, ok)
+	}
+	if err := entries["Command will be retried."].Err(); !errors.Is(err, APCError{Code: "E28866"}) {
+		t.Errorf("Err() = %v, want E28866", err)
+	}
+	if err := sent.Err(); err != nil {
+		t.Errorf("Err() = %v of the entry without error", err)
+	}
+}
+
+func TestZapField(t *testing.T) {
+	for _, tc := range []struct {
+		value interface{}
+		want  zapcore.FieldType
+	}{
+		{"AGTLogon", zapcore.StringType},
+		{uint32(7), zapcore.Uint32Type},
+		{3, zapcore.Int64Type},
+		{errors.New("failure"), zapcore.ErrorType},
+		{ServerInfo{Name: "Agent server"}, zapcore.ReflectType},
+	} {
+		if got := zapField("field", tc.value).Type; got != tc.want {
+			t.Errorf("zapField(%#v) type = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 
 	"github.com/L11R/go-apc"
@@ -33,66 +32,21 @@ func main() {
 		panic(err)
 	}
 
-	shutdown := make(chan error)
-	go func(shutdown chan<- error) {
-		shutdown <- client.Start()
-	}(shutdown)
+	go client.Start()
 
-	if err := client.Logon(context.Background(), agentName, password); err != nil {
-		panic(err)
-	}
-
-	defer func() {
-		if err := client.Logoff(context.Background()); err != nil {
-			log.Println(err)
-		}
-	}()
-
-	if err := client.ReserveHeadset(context.Background(), headsetID); err != nil {
-		panic(err)
-	}
-	defer func() {
-		if err := client.FreeHeadset(context.Background()); err != nil {
-			log.Println(err)
-		}
-	}()
-
-	if err := client.ConnectHeadset(context.Background()); err != nil {
-		panic(err)
-	}
-	defer func() {
-		if err := client.DisconnectHeadset(context.Background()); err != nil {
-			log.Println(err)
-		}
-	}()
-
-	if err := client.AttachJob(context.Background(), jobName); err != nil {
-		panic(err)
-	}
-	defer func() {
-		if err := client.DetachJob(context.Background()); err != nil {
-			log.Println(err)
-		}
-	}()
-
-	keys, err := client.ListState(context.Background())
+	session := apc.NewAgentSession(client)
+	err = session.Open(context.Background(), apc.Credentials{
+		AgentName:  agentName,
+		Password:   password,
+		HeadsetID:  headsetID,
+		JobName:    jobName,
+		DataFields: []string{"DEBT_ID", "CURPHONE"},
+	})
 	if err != nil {
 		panic(err)
 	}
-	_ = keys
-
-	if err := client.SetDataField(context.Background(), apc.ListTypeOutbound, "DEBT_ID"); err != nil {
-		panic(err)
-	}
-	if err := client.SetDataField(context.Background(), apc.ListTypeOutbound, "CURPHONE"); err != nil {
-		panic(err)
-	}
-
-	if err := client.AvailWork(context.Background()); err != nil {
-		panic(err)
-	}
 	defer func() {
-		if err := client.NoFurtherWork(context.Background()); err != nil {
+		if err := session.Close(context.Background()); err != nil {
 			log.Println(err)
 		}
 	}()
@@ -105,37 +59,36 @@ func main() {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
+	notifications := client.Notifications(context.Background())
 	for {
 		select {
 		case <-sig:
 			return
-		case <-shutdown:
+		case <-client.Done():
+			log.Println(client.Wait())
 			return
-		case notification, ok := <-client.Notifications(context.Background()):
+		case notification, ok := <-notifications:
 			if !ok {
 				fmt.Println("notification channel closed!")
 				return
 			}
 
 			if notification.Type == apc.NotificationTypeCallNotify {
-				for k, v := range notification.Payload.(map[string]string) {
-					if k != "CURPHONE" {
-						continue
-					}
-
-					id, err := strconv.Atoi(v)
+				fields := apc.Fields(notification.Payload.(map[string]string))
+				if _, ok := fields["CURPHONE"]; ok {
+					id, err := fields.Int("CURPHONE")
 					if err != nil {
 						log.Println(err)
 						break
 					}
 
-					field, err := client.ReadField(context.Background(), apc.ListTypeOutbound, "PHONE_ID"+strconv.Itoa(id))
+					phone, err := client.ReadPhoneField(context.Background(), apc.ListTypeOutbound, id)
 					if err != nil {
 						log.Println(err)
 						break
 					}
 
-					fmt.Println(field)
+					fmt.Println(phone)
 				}
 			}
 
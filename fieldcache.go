@@ -0,0 +1,84 @@
+package apc
+
+import (
+	"sync"
+	"time"
+)
+
+// fieldKey identifies a cached field; the record is the generation of the customer record the field was read from.
+type fieldKey struct {
+	listType ListType
+	record   uint64
+	name     string
+}
+
+type fieldEntry struct {
+	field   Field
+	expires time.Time
+}
+
+// fieldCache is the read-through cache of ReadField, see WithFieldCache.
+// Agent API has no record IDs, so records are told apart by generations: the generation is bumped
+// every time a record is delivered or finished, and entries of previous generations are dropped.
+type fieldCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	record  uint64
+	entries map[fieldKey]fieldEntry
+}
+
+func newFieldCache(ttl time.Duration) *fieldCache {
+	return &fieldCache{ttl: ttl, entries: make(map[fieldKey]fieldEntry)}
+}
+
+// current returns the generation of the current record.
+func (f *fieldCache) current() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.record
+}
+
+// get returns the field of the current record if it has been read within the TTL.
+func (f *fieldCache) get(listType ListType, name string) (*Field, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, ok := f.entries[fieldKey{listType: listType, record: f.record, name: name}]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+
+	field := entry.field
+	return &field, true
+}
+
+// put caches the field read from the record of the given generation, unless the record has changed meanwhile.
+func (f *fieldCache) put(listType ListType, record uint64, name string, field *Field) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if record != f.record {
+		return
+	}
+
+	f.entries[fieldKey{listType: listType, record: record, name: name}] = fieldEntry{field: *field, expires: time.Now().Add(f.ttl)}
+}
+
+// drop removes the field of the current record, e.g. after it has been updated.
+func (f *fieldCache) drop(listType ListType, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.entries, fieldKey{listType: listType, record: f.record, name: name})
+}
+
+// next switches the cache to the next record.
+func (f *fieldCache) next() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.record++
+	f.entries = make(map[fieldKey]fieldEntry)
+}
@@ -0,0 +1,57 @@
+package apc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields are field values mapped by field names, as returned by ReadFields and sent with call notification
+// and preview events: the payload of those can be converted with Fields(payload.(map[string]string)).
+type Fields map[string]string
+
+// String returns the value of the field with surrounding spaces trimmed, or an empty string if it's missing.
+func (f Fields) String(name string) string {
+	return strings.TrimSpace(f[name])
+}
+
+// Int parses the value of a numeric field.
+func (f Fields) Int(name string) (int, error) {
+	value, err := f.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value of field %s: %w", name, err)
+	}
+
+	return i, nil
+}
+
+// Time parses the value of a date or time field using the layout, as time.Parse does.
+func (f Fields) Time(name, layout string) (time.Time, error) {
+	value, err := f.lookup(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid value of field %s: %w", name, err)
+	}
+
+	return t, nil
+}
+
+// lookup returns the trimmed value of the field, fields are padded with spaces up to their length.
+func (f Fields) lookup(name string) (string, error) {
+	value, ok := f[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrFieldNotFound, name)
+	}
+
+	return strings.TrimSpace(value), nil
+}
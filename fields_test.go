@@ -0,0 +1,50 @@
+package apc
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFields(t *testing.T) {
+	f := Fields{
+		"CURPHONE": "01",
+		"BALANCE":  "  1500",
+		"DUEDATE":  "2024/03/15",
+		"NAME":     "John Smith  ",
+		"BROKEN":   "12a",
+	}
+
+	if got := f.String("NAME"); got != "John Smith" {
+		t.Errorf("String() = %q, want %q", got, "John Smith")
+	}
+	if got := f.String("MISSING"); got != "" {
+		t.Errorf("String() = %q, want empty string", got)
+	}
+
+	if got, err := f.Int("CURPHONE"); err != nil || got != 1 {
+		t.Errorf("Int() = %d, %v, want 1", got, err)
+	}
+	if got, err := f.Int("BALANCE"); err != nil || got != 1500 {
+		t.Errorf("Int() = %d, %v, want 1500", got, err)
+	}
+	var numErr *strconv.NumError
+	if _, err := f.Int("BROKEN"); !errors.As(err, &numErr) {
+		t.Errorf("Int() error = %v, want *strconv.NumError", err)
+	}
+	if _, err := f.Int("MISSING"); !errors.Is(err, ErrFieldNotFound) {
+		t.Errorf("Int() error = %v, want %v", err, ErrFieldNotFound)
+	}
+
+	want := time.Date(2024, time.March, 15, 0, 0, 0, 0, time.UTC)
+	if got, err := f.Time("DUEDATE", "2006/01/02"); err != nil || !got.Equal(want) {
+		t.Errorf("Time() = %v, %v, want %v", got, err, want)
+	}
+	if _, err := f.Time("NAME", "2006/01/02"); err == nil {
+		t.Error("Time() error = nil, want parse error")
+	}
+	if _, err := f.Time("MISSING", "2006/01/02"); !errors.Is(err, ErrFieldNotFound) {
+		t.Errorf("Time() error = %v, want %v", err, ErrFieldNotFound)
+	}
+}
@@ -47,6 +47,43 @@ type LogEntry struct {
 	Fields  map[string]interface{}
 }
 
+// Keys of the fields that log entries of commands and events share, their values always have the same type,
+// so a LogHandler could read them with LogEntry accessors instead of type assertions.
+const (
+	// LogFieldKeyword is the keyword of the command or the event, a string
+	LogFieldKeyword = "keyword"
+	// LogFieldInvokeID is the invoke ID of the command or the event, an uint32
+	LogFieldInvokeID = "invoke_id"
+	// LogFieldRaw is the raw frame of the command or the event, a string
+	LogFieldRaw = "raw"
+	// LogFieldError is the error, an error
+	LogFieldError = "error"
+)
+
+// Keyword returns the LogFieldKeyword field and whether the entry has it.
+func (e LogEntry) Keyword() (string, bool) {
+	keyword, ok := e.Fields[LogFieldKeyword].(string)
+	return keyword, ok
+}
+
+// InvokeID returns the LogFieldInvokeID field and whether the entry has it.
+func (e LogEntry) InvokeID() (uint32, bool) {
+	invokeID, ok := e.Fields[LogFieldInvokeID].(uint32)
+	return invokeID, ok
+}
+
+// Raw returns the LogFieldRaw field and whether the entry has it.
+func (e LogEntry) Raw() (string, bool) {
+	raw, ok := e.Fields[LogFieldRaw].(string)
+	return raw, ok
+}
+
+// Err returns the LogFieldError field, it's nil if the entry has no error.
+func (e LogEntry) Err() error {
+	err, _ := e.Fields[LogFieldError].(error)
+	return err
+}
+
 // newLogEntry helps to create Entry.
 func newLogEntry(level LogLevel, message string, fields ...map[string]interface{}) LogEntry {
 	var f map[string]interface{}
@@ -1,10 +1,21 @@
 package apc
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type arg struct {
@@ -19,14 +30,25 @@ func newArg(key, value string) arg {
 	}
 }
 
-func newRequest(ctx context.Context) *request {
-	// Add cancellation context to parent one
-	ctx, cancel := context.WithCancel(ctx)
+func newRequest(ctx context.Context, timeout *time.Duration) *request {
+	var cancel context.CancelFunc
+
+	// Add cancellation context to parent one; bound it by the timeout if the parent has no deadline
+	ctx, abort := context.WithCancelCause(ctx)
+	if _, ok := ctx.Deadline(); !ok && timeout != nil {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
 
 	// Create dedicated event channel for this request
 	return &request{
 		context: ctx,
-		cancel:  cancel,
+		cancel: func() {
+			cancel()
+			abort(nil)
+		},
+		abort: abort,
 		// Usually one request needs two events: data and response
 		eventChan: make(chan Event, 2),
 	}
@@ -34,73 +56,321 @@ func newRequest(ctx context.Context) *request {
 
 func (c *Client) invokeCommand(ctx context.Context, keyword string, args ...arg) (*request, uint32, error) {
 	invokeID := c.invokeIDPool.Get()
+	if c.logger.enabled(LogLevelDebug) {
+		c.logger.log(newLogEntry(LogLevelDebug, "Invoke ID has allocated.", map[string]interface{}{LogFieldKeyword: keyword, LogFieldInvokeID: invokeID}))
+	}
+
+	// Create the request and place it into the requests map first, so it's tracked during the whole lifecycle;
+	// anyway it should be done BEFORE writing a command into connection to avoid the situation while server responds
+	// so quickly that events being just skipped before processing goroutine even started
+	r := c.newCommandRequest(ctx, keyword, invokeID)
+	c.mu.Lock()
+	c.requests[invokeID] = r
+	// Only the graceful logoff runs commands while the client is draining
+	state := c.state.Load()
+	accepted := state == ConnOK || state == ConnDraining && ctx.Value(logoffKey{}) != nil
+	if accepted {
+		c.inflight.Add(1)
+		r.inflight = true
+	}
+	c.mu.Unlock()
 
-	if c.state.Load() != ConnOK {
-		return nil, invokeID, ErrConnectionClosed
+	if !accepted {
+		return nil, invokeID, r.fail(ErrConnectionClosed)
 	}
 
-	fields := map[string]interface{}{
-		"type":      string(EventTypeCommand),
-		"keyword":   keyword,
-		"invoke_id": invokeID,
+	// Wait for a free slot if concurrent commands are limited, the slot is released by destroyCommand
+	if c.commandSlots != nil {
+		select {
+		case c.commandSlots <- struct{}{}:
+			r.slot = true
+		case <-r.context.Done():
+			return nil, invokeID, r.fail(fmt.Errorf("command is queued: %w", context.Cause(r.context)))
+		}
 	}
 
+	// Arguments of some commands differ between server versions
+	args = c.protocolVersion.adaptArgs(keyword, args)
+
 	var flatArgs []string
 	if len(args) > 0 {
 		flatArgs = make([]string, 0, len(args))
 		for _, arg := range args {
 			flatArgs = append(flatArgs, arg.value)
-			fields[arg.key] = arg.value
 		}
 	}
-	fields["segments"] = flatArgs
 
 	// Encode command
 	b, err := encodeCommand(keyword, invokeID, flatArgs...)
 	if err != nil {
-		return nil, invokeID, fmt.Errorf("cannot encode command: %w", err)
+		return nil, invokeID, r.fail(fmt.Errorf("cannot encode command: %w", err))
+	}
+	if c.logger.enabled(LogLevelDebug) {
+		c.logger.log(newLogEntry(LogLevelDebug, "Command has encoded.", map[string]interface{}{LogFieldRaw: string(b)}))
 	}
-	c.logger.log(newLogEntry(LogLevelDebug, "Command has encoded.", map[string]interface{}{"raw": string(b)}))
-
-	// Create the request and place it into the requests map;
-	// it should be done BEFORE writing a command into connection to avoid the situation while server responds
-	// so quickly that events being just skipped before processing goroutine even started
-	r := newRequest(ctx)
-	c.mu.Lock()
-	c.requests[invokeID] = r
-	c.mu.Unlock()
 
 	// Write command to connection
-	if _, err := c.conn.Write(b); err != nil {
-		return nil, invokeID, fmt.Errorf("cannot write command: %w", err)
+	if err := c.write(r.context, b); err != nil {
+		return nil, invokeID, r.fail(fmt.Errorf("cannot write command: %w", err))
 	}
 
-	c.logger.log(newLogEntry(LogLevelInfo, "Command has sent.", fields))
+	r.written = true
+	c.lastCommand.Store(time.Now().UnixNano())
+
+	if c.logger.enabled(LogLevelInfo) {
+		fields := map[string]interface{}{
+			"type":           string(EventTypeCommand),
+			LogFieldKeyword:  keyword,
+			LogFieldInvokeID: invokeID,
+			"segments":       flatArgs,
+		}
+		for _, arg := range args {
+			fields[arg.key] = arg.value
+		}
+		c.logger.log(newLogEntry(LogLevelInfo, "Command has sent.", fields))
+	}
 
 	return r, invokeID, nil
 }
 
+// newCommandRequest creates the request of the command and starts its span.
+func (c *Client) newCommandRequest(ctx context.Context, keyword string, invokeID uint32) *request {
+	ctx, span := c.tracer.Start(
+		ctx,
+		keyword,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("apc.keyword", keyword),
+			attribute.Int64("apc.invoke_id", int64(invokeID)),
+		),
+	)
+
+	r := newRequest(ctx, c.opts.CommandTimeout)
+	r.keyword = keyword
+	r.started = time.Now()
+	r.span = span
+
+	c.metrics.CommandStarted(keyword)
+
+	return r
+}
+
+// finishRequest releases resources of the completed request, ends its span and reports metrics.
+func (c *Client) finishRequest(r *request) {
+	r.cancel()
+
+	c.releaseSlot(r)
+	if r.inflight {
+		c.inflight.Done()
+	}
+
+	if len(r.events) > 0 {
+		c.lastResponseMu.Lock()
+		c.lastResponse = r.events
+		c.lastResponseMu.Unlock()
+	}
+
+	c.metrics.CommandFinished(r.keyword, time.Since(r.started), r.err)
+
+	if r.err != nil {
+		var apcErr APCError
+		if errors.As(r.err, &apcErr) {
+			r.span.SetAttributes(attribute.String("apc.error_code", apcErr.Code))
+		}
+
+		r.span.RecordError(r.err)
+		r.span.SetStatus(codes.Error, r.err.Error())
+	}
+	r.span.End()
+}
+
+// releaseSlot gives the slot of concurrent commands back before the request is finished,
+// e.g. for a command whose response the server holds until another command is sent.
+func (c *Client) releaseSlot(r *request) {
+	if r.slot {
+		r.slot = false
+		<-c.commandSlots
+	}
+}
+
+// execute executes the command and returns its data segments.
+func (c *Client) execute(ctx context.Context, keyword string, args ...arg) ([]string, error) {
+	r, invokeID, err := c.invokeCommand(ctx, keyword, args...)
+	defer c.destroyCommand(invokeID)
+	if err != nil {
+		return nil, fmt.Errorf("error while executing %s command: %w", keyword, err)
+	}
+
+	return processRequest(r)
+}
+
+// query executes the idempotent command, e.g. a list or a read one; unlike state-mutating commands
+// it's retried on transient errors according to the RetryPolicy (see WithCommandRetry).
+func (c *Client) query(ctx context.Context, keyword string, args ...arg) ([]string, error) {
+	return c.executeRetry(ctx, c.opts.RetryPolicy, keyword, args...)
+}
+
+// executeRetry executes the command and retries it on errors that are transient according to the policy.
+func (c *Client) executeRetry(ctx context.Context, policy RetryPolicy, keyword string, args ...arg) ([]string, error) {
+	backoff := policy.Backoff
+
+	for attempt := 1; ; attempt++ {
+		segments, err := c.execute(ctx, keyword, args...)
+		if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err) {
+			return segments, err
+		}
+
+		c.logger.log(newLogEntry(LogLevelInfo, "Command will be retried.", map[string]interface{}{LogFieldKeyword: keyword, "attempt": attempt, LogFieldError: err}))
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// write writes the whole encoded command to the connection at once.
+// The write is bounded by the context deadline and the write timeout (see WithWriteTimeout), whichever comes first.
+// A timed out write could leave a partial frame behind, so the connection is shut down in that case.
+func (c *Client) write(ctx context.Context, b []byte) error {
+	// Writers waiting for the lock are counted, see writeFrame
+	c.queuedWrites.Inc()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.queuedWrites.Dec()
+
+	deadline, ok := ctx.Deadline()
+	if c.opts.WriteTimeout != nil {
+		if d := time.Now().Add(*c.opts.WriteTimeout); !ok || d.Before(deadline) {
+			deadline, ok = d, true
+		}
+	}
+	if ok {
+		if err := c.conn.SetWriteDeadline(deadline); err != nil {
+			// Frames left in the buffer by previous writers are still to be flushed
+			_ = c.writeFrame(nil)
+			return err
+		}
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+
+	// Encoder isn't safe for concurrent use, it's guarded by the write lock too
+	raw := b
+	if c.opts.Encoder != nil {
+		var err error
+		if raw, err = c.opts.Encoder.Bytes(b); err != nil {
+			// Frames left in the buffer by previous writers are still to be flushed
+			_ = c.writeFrame(nil)
+			return fmt.Errorf("cannot encode command: %w", err)
+		}
+	}
+
+	// Record the command before it's sent, so it always goes before its response
+	c.wireLog.write(b)
+	err := c.writeFrame(raw)
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		err = fmt.Errorf("%w: %w", ErrWriteTimeout, err)
+		c.logger.log(newLogEntry(LogLevelError, "Write has timed out, closing the connection!", map[string]interface{}{LogFieldError: err}))
+
+		select {
+		case c.shutdown <- err:
+		default:
+		}
+	}
+
+	return err
+}
+
+// writeFrame writes the frame to the connection, it must be called with the write lock held.
+// With the write buffer (see WithWriteBuffer) the frame is left in the buffer if other writers are queued
+// for the lock: the last of them flushes the frames of all, so a command is never left unsent while its response
+// is awaited. A nil frame only flushes the buffer if needed.
+func (c *Client) writeFrame(raw []byte) error {
+	if c.writeBuf == nil {
+		if len(raw) == 0 {
+			return nil
+		}
+
+		_, err := c.conn.Write(raw)
+		return err
+	}
+
+	if _, err := c.writeBuf.Write(raw); err != nil {
+		return err
+	}
+	if c.queuedWrites.Load() > 0 || c.writeBuf.Buffered() == 0 {
+		return nil
+	}
+
+	return c.writeBuf.Flush()
+}
+
 func (c *Client) destroyCommand(invokeID uint32) {
 	c.mu.RLock()
-	_, ok := c.requests[invokeID]
+	r, ok := c.requests[invokeID]
 	c.mu.RUnlock()
 
 	// in case of executeCommand func returned an error just release invoke id from pool
 	if !ok {
-		c.invokeIDPool.Release(invokeID)
+		c.releaseInvokeID(invokeID, "")
 		return
 	}
 
-	// Delete request from pool
+	// Release resources associated with the request
+	c.finishRequest(r)
+
+	// The server still responds to a timed out or cancelled command, its invoke ID isn't reused until then:
+	// otherwise the next command with the same keyword could take the late response for its own
 	c.mu.Lock()
+	if r.written && !r.responded && c.state.Load() != ConnClosed {
+		r.abandoned = true
+		c.mu.Unlock()
+		return
+	}
+	// Delete request from pool
 	delete(c.requests, invokeID)
 	c.mu.Unlock()
 
 	// Finally release invoke ID
+	c.releaseInvokeID(invokeID, r.keyword)
+}
+
+// releaseAbandoned deletes the abandoned request once its late response has arrived and releases its invoke ID.
+func (c *Client) releaseAbandoned(invokeID uint32, r *request) {
+	c.mu.Lock()
+	// The connection could have been closed meanwhile, then it's released already
+	if c.requests[invokeID] != r {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.requests, invokeID)
+	c.mu.Unlock()
+
+	c.logger.log(newLogEntry(LogLevelInfo, "Late response has arrived.", map[string]interface{}{LogFieldKeyword: r.keyword, LogFieldInvokeID: invokeID}))
+	c.releaseInvokeID(invokeID, r.keyword)
+}
+
+// releaseInvokeID returns the invoke ID of the command to the pool.
+func (c *Client) releaseInvokeID(invokeID uint32, keyword string) {
 	c.invokeIDPool.Release(invokeID)
+	if c.logger.enabled(LogLevelDebug) {
+		c.logger.log(newLogEntry(LogLevelDebug, "Invoke ID has released.", map[string]interface{}{LogFieldKeyword: keyword, LogFieldInvokeID: invokeID}))
+	}
 }
 
+// Logon logs the agent on to Proactive Contact. Trailing whitespace of the agent name and the password is trimmed,
+// since it often comes from command line flags or files; empty ones are rejected with ErrInvalidCredentials.
 func (c *Client) Logon(ctx context.Context, agentName string, password string) error {
+	agentName = strings.TrimRightFunc(agentName, unicode.IsSpace)
+	password = strings.TrimRightFunc(password, unicode.IsSpace)
+	if agentName == "" || password == "" {
+		return ErrInvalidCredentials
+	}
+
 	r, invokeID, err := c.invokeCommand(ctx, "AGTLogon", newArg("agent_name", agentName), newArg("password", password), newArg("version", "GOLANG_0.0.3"))
 	defer c.destroyCommand(invokeID)
 	if err != nil {
@@ -114,7 +384,51 @@ func (c *Client) Logon(ctx context.Context, agentName string, password string) e
 	return nil
 }
 
+// HeadsetState is the headset state tracked by the client. The headset goes through the states in order:
+//
+//	free --ReserveHeadset--> reserved --ConnectHeadset--> connected
+//	connected --DisconnectHeadset or AGTHeadsetConnBroken--> reserved --FreeHeadset--> free
+//
+// The agent binary has no command to release a headset, FreeHeadset is the one. ReleaseLine and HangupCall
+// deal with the telephone line of a customer call and never change the headset state.
+type HeadsetState uint32
+
+const (
+	HeadsetFree HeadsetState = iota
+	HeadsetReserved
+	HeadsetConnected
+)
+
+func (s HeadsetState) String() string {
+	switch s {
+	case HeadsetFree:
+		return "free"
+	case HeadsetReserved:
+		return "reserved"
+	case HeadsetConnected:
+		return "connected"
+	default:
+		return "unknown"
+	}
+}
+
+// HeadsetStatus returns the headset state. Agent API has no command to query it, so it's the state tracked
+// by the client: it follows the headset commands and AGTHeadsetConnBroken notification.
+func (c *Client) HeadsetStatus() HeadsetState {
+	return HeadsetState(c.headset.Load())
+}
+
+// ReserveHeadset reserves the headset for the agent. It's a no-op if the client has already reserved the same headset
+// and ErrHeadsetAlreadyReserved if another one. FreeHeadset undoes the reservation, e.g. when ConnectHeadset fails:
+// Agent API has no separate command to cancel it.
 func (c *Client) ReserveHeadset(ctx context.Context, headsetID int) error {
+	if c.HeadsetStatus() != HeadsetFree {
+		if c.headsetID.Load() == int64(headsetID) {
+			return nil
+		}
+		return ErrHeadsetAlreadyReserved
+	}
+
 	r, invokeID, err := c.invokeCommand(ctx, "AGTReserveHeadset", newArg("headset_id", strconv.Itoa(headsetID)))
 	defer c.destroyCommand(invokeID)
 	if err != nil {
@@ -124,20 +438,36 @@ func (c *Client) ReserveHeadset(ctx context.Context, headsetID int) error {
 	if _, err := processRequest(r); err != nil {
 		return err
 	}
+	c.headsetID.Store(int64(headsetID))
+	c.headset.Store(uint32(HeadsetReserved))
 
 	return nil
 }
 
+// ConnectHeadset connects the reserved headset, it's a no-op if the headset is already connected
+// and ErrHeadsetNotReserved if there is no reserved headset.
+// The connection has no modes: Proactive Contact calls the extension of the headset and keeps the voice line
+// open for all the calls of the session. Whether calls are delivered predictively or after a preview depends
+// on the attached job and the work class (see SetWorkClass and PreviewRecord), not on the headset.
 func (c *Client) ConnectHeadset(ctx context.Context) error {
+	switch c.HeadsetStatus() {
+	case HeadsetConnected:
+		return nil
+	case HeadsetFree:
+		return ErrHeadsetNotReserved
+	}
+
 	r, invokeID, err := c.invokeCommand(ctx, "AGTConnHeadset")
 	defer c.destroyCommand(invokeID)
 	if err != nil {
 		return fmt.Errorf("error while executing AGTConnHeadset command: %w", err)
 	}
 
-	if _, err := processRequest(r); err != nil {
+	// E28872: headset is already connected
+	if _, err := processRequest(r); err != nil && !errors.Is(err, APCError{Code: "E28872"}) {
 		return err
 	}
+	c.headset.Store(uint32(HeadsetConnected))
 
 	return nil
 }
@@ -166,13 +496,7 @@ const (
 )
 
 func (c *Client) ListJobs(ctx context.Context, jobType JobType) ([]Job, error) {
-	r, invokeID, err := c.invokeCommand(ctx, "AGTListJobs", newArg("job_type", string([]byte{byte(jobType)})))
-	defer c.destroyCommand(invokeID)
-	if err != nil {
-		return nil, fmt.Errorf("error while executing AGTListJobs command: %w", err)
-	}
-
-	rawSegments, err := processRequest(r)
+	rawSegments, err := c.query(ctx, "AGTListJobs", newArg("job_type", string([]byte{byte(jobType)})))
 	if err != nil {
 		return nil, err
 	}
@@ -192,14 +516,26 @@ func (c *Client) ListJobs(ctx context.Context, jobType JobType) ([]Job, error) {
 	return jobs, nil
 }
 
-func (c *Client) ListCallLists(ctx context.Context) ([]string, error) {
-	r, invokeID, err := c.invokeCommand(ctx, "AGTListCallLists")
-	defer c.destroyCommand(invokeID)
+// ListJobsFiltered returns jobs of the type that are in the status, e.g. StatusTypeActive for jobs an agent could join.
+// AGTListJobs has no status parameter, so the jobs are filtered on the client side.
+func (c *Client) ListJobsFiltered(ctx context.Context, jobType JobType, status StatusType) ([]Job, error) {
+	jobs, err := c.ListJobs(ctx, jobType)
 	if err != nil {
-		return nil, fmt.Errorf("error while executing AGTListCallLists command: %w", err)
+		return nil, err
+	}
+
+	filtered := jobs[:0]
+	for _, job := range jobs {
+		if job.Status == status {
+			filtered = append(filtered, job)
+		}
 	}
 
-	rawSegments, err := processRequest(r)
+	return filtered, nil
+}
+
+func (c *Client) ListCallLists(ctx context.Context) ([]string, error) {
+	rawSegments, err := c.query(ctx, "AGTListCallLists")
 	if err != nil {
 		return nil, err
 	}
@@ -212,27 +548,65 @@ func (c *Client) ListCallLists(ctx context.Context) ([]string, error) {
 	return callLists, nil
 }
 
+// ListCallFields returns names of fields of the calling list, they are valid for SetDataField, SetNotifyKeyField
+// and ReadField. Agent API lists fields of a calling list by its name only, even for the call in progress;
+// fields of the list used by the attached job along with their formats are returned by ListDataFields.
 func (c *Client) ListCallFields(ctx context.Context, listName string) ([]string, error) {
-	r, invokeID, err := c.invokeCommand(ctx, "AGTListCallFields", newArg("list_name", listName))
-	defer c.destroyCommand(invokeID)
-	if err != nil {
-		return nil, fmt.Errorf("error while executing AGTListCallFields command: %w", err)
-	}
-
-	rawSegments, err := processRequest(r)
+	rawSegments, err := c.query(ctx, "AGTListCallFields", newArg("list_name", listName))
 	if err != nil {
 		return nil, err
 	}
 
 	callFields := make([]string, 0, len(rawSegments))
 	for _, segment := range rawSegments {
-		callFields = append(callFields, segment)
+		// Every field is formatted as "name,length,type,F", the data message code isn't a field
+		name, _, ok := strings.Cut(segment, ",")
+		if !ok {
+			continue
+		}
+		callFields = append(callFields, strings.TrimSpace(name))
 	}
 
 	return callFields, nil
 }
 
+// AttachJob attaches the agent to the active job, it's the same as AttachJobOpts with zero AttachOptions.
 func (c *Client) AttachJob(ctx context.Context, jobName string) error {
+	return c.AttachJobOpts(ctx, jobName, AttachOptions{})
+}
+
+// AttachOptions are the job setup steps of AttachJobOpts.
+// AGTAttachJob itself takes only the job name, so the options are sent as separate commands around it.
+// There is no headset mode either: see ConnectHeadset.
+type AttachOptions struct {
+	// WorkClass is set with SetWorkClass before attaching the job, zero value leaves the current one
+	WorkClass WorkClass
+	// AutoAvail makes the agent available for work with AvailWork once the job is attached
+	AutoAvail bool
+}
+
+// AttachJobOpts attaches the agent to the active job with the given setup:
+// the work class is set first, then the job is attached and the agent is made available for work.
+// The job stays attached if AvailWork fails, detach it with DetachJob if needed.
+func (c *Client) AttachJobOpts(ctx context.Context, jobName string, opts AttachOptions) error {
+	if opts.WorkClass != 0 {
+		if err := c.SetWorkClass(ctx, opts.WorkClass); err != nil {
+			return err
+		}
+	}
+
+	if err := c.attachJob(ctx, jobName); err != nil {
+		return err
+	}
+
+	if opts.AutoAvail {
+		return c.AvailWork(ctx)
+	}
+
+	return nil
+}
+
+func (c *Client) attachJob(ctx context.Context, jobName string) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTAttachJob", newArg("job_name", jobName))
 	defer c.destroyCommand(invokeID)
 	if err != nil {
@@ -246,6 +620,10 @@ func (c *Client) AttachJob(ctx context.Context, jobName string) error {
 	return nil
 }
 
+// ListType is the type of calling list the attached job uses. Agent API knows only two of them:
+// inbound jobs use inbound lists, while outbound, Managed Dialing, Unit Work List and Sales Verification jobs
+// use outbound lists; blend jobs use both. All the list commands take the list type as an argument,
+// there are no separate commands per list type.
 type ListType byte
 
 const (
@@ -253,28 +631,50 @@ const (
 	ListTypeInbound  ListType = 'I'
 )
 
+func (t ListType) String() string {
+	switch t {
+	case ListTypeOutbound:
+		return "outbound"
+	case ListTypeInbound:
+		return "inbound"
+	default:
+		return "unknown"
+	}
+}
+
+// IsValid tells whether Agent API knows the list type.
+func (t ListType) IsValid() bool {
+	return t == ListTypeOutbound || t == ListTypeInbound
+}
+
+// DataField describes a field of the calling list: values passed to UpdateField must fit its type and length.
 type DataField struct {
-	Name string
+	Name   string
+	Type   FieldType
+	Length int
 }
 
+// ListDataFields returns data fields of the given list, their names are valid for SetDataField and ReadField.
 func (c *Client) ListDataFields(ctx context.Context, listType ListType) ([]DataField, error) {
-	r, invokeID, err := c.invokeCommand(ctx, "AGTListDataFields", newArg("list_type", string([]byte{byte(listType)})))
-	defer c.destroyCommand(invokeID)
-	if err != nil {
-		return nil, fmt.Errorf("error while executing AGTListDataFields command: %w", err)
-	}
-
-	rawSegments, err := processRequest(r)
+	rawSegments, err := c.query(ctx, "AGTListDataFields", newArg("list_type", string([]byte{byte(listType)})))
 	if err != nil {
 		return nil, err
 	}
 
 	dataFields := make([]DataField, 0, len(rawSegments))
 	for _, segment := range rawSegments {
+		// Every field is formatted as "name,length,type,F"
 		dataFieldParts := strings.Split(segment, ",")
 		if len(dataFieldParts) == 4 {
+			length, err := strconv.Atoi(dataFieldParts[1])
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert length of field %s: %w", dataFieldParts[0], err)
+			}
+
 			dataFields = append(dataFields, DataField{
-				Name: dataFieldParts[0],
+				Name:   dataFieldParts[0],
+				Type:   FieldType(dataFieldParts[2]),
+				Length: length,
 			})
 		}
 	}
@@ -282,6 +682,170 @@ func (c *Client) ListDataFields(ctx context.Context, listType ListType) ([]DataF
 	return dataFields, nil
 }
 
+// ListScreens returns names of agent screens of the given list type defined for the attached job.
+func (c *Client) ListScreens(ctx context.Context, listType ListType) ([]string, error) {
+	rawSegments, err := c.query(ctx, "AGTListScreens", newArg("list_type", string([]byte{byte(listType)})))
+	if err != nil {
+		return nil, err
+	}
+
+	screens := make([]string, 0, len(rawSegments))
+	for _, segment := range rawSegments {
+		// Every data message starts with its code, it's not a screen
+		if segment == "M00001" {
+			continue
+		}
+		screens = append(screens, segment)
+	}
+
+	return screens, nil
+}
+
+// ListFieldLabels returns display labels of fields of the given list type, mapped by field names.
+// The protocol has no labels for calling list fields, so they are taken from the agent screens of the attached job:
+// words of labels placed in front of a field on the same row make its label. Fields without labels are omitted.
+func (c *Client) ListFieldLabels(ctx context.Context, listType ListType) (map[string]string, error) {
+	screens, err := c.ListScreens(ctx, listType)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string)
+	for _, screen := range screens {
+		rawSegments, err := c.query(ctx, "AGTGetScreen", newArg("screen_name", screen))
+		if err != nil {
+			return nil, err
+		}
+
+		for name, label := range parseScreenLabels(rawSegments) {
+			// The first screen wins
+			if _, ok := labels[name]; !ok {
+				labels[name] = label
+			}
+		}
+	}
+
+	return labels, nil
+}
+
+// FieldDescriptor describes a data field of the calling list along with its display label,
+// e.g. to build an agent form. Label is empty if no agent screen labels the field.
+type FieldDescriptor struct {
+	DataField
+	Label string
+}
+
+// DescribeFields returns data fields of the given list with their labels, in order of ListDataFields.
+// ListDataFields and ListFieldLabels are requested concurrently, the first error is returned.
+func (c *Client) DescribeFields(ctx context.Context, listType ListType) ([]FieldDescriptor, error) {
+	type labelsResult struct {
+		labels map[string]string
+		err    error
+	}
+
+	labelsCh := make(chan labelsResult, 1)
+	go func() {
+		labels, err := c.ListFieldLabels(ctx, listType)
+		labelsCh <- labelsResult{labels: labels, err: err}
+	}()
+
+	dataFields, err := c.ListDataFields(ctx, listType)
+	res := <-labelsCh
+	if err != nil {
+		return nil, err
+	}
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	return describeFields(dataFields, res.labels), nil
+}
+
+// describeFields merges data fields and labels mapped by field names.
+func describeFields(dataFields []DataField, labels map[string]string) []FieldDescriptor {
+	descriptors := make([]FieldDescriptor, 0, len(dataFields))
+	for _, field := range dataFields {
+		descriptors = append(descriptors, FieldDescriptor{
+			DataField: field,
+			Label:     labels[field.Name],
+		})
+	}
+
+	return descriptors
+}
+
+// screenElement is a field (F) or a label (L) record of an agent screen definition, e.g. F, 9,12, 4,"CARDTYPE:1:0:C::0:1".
+type screenElement struct {
+	x, y, width int
+	text        string
+}
+
+// parseScreenLabels matches fields of the screen definition returned by AGTGetScreen with their labels.
+func parseScreenLabels(segments []string) map[string]string {
+	var fields, labels []screenElement
+	for _, segment := range segments {
+		parts := strings.SplitN(segment, ",", 5)
+		if len(parts) != 5 {
+			continue
+		}
+
+		var (
+			element screenElement
+			err     error
+		)
+		if element.x, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			continue
+		}
+		if element.y, err = strconv.Atoi(strings.TrimSpace(parts[2])); err != nil {
+			continue
+		}
+		if element.width, err = strconv.Atoi(strings.TrimSpace(parts[3])); err != nil {
+			continue
+		}
+		element.text = strings.Trim(strings.TrimSpace(parts[4]), `"`)
+
+		switch strings.TrimSpace(parts[0]) {
+		case "F":
+			// Field name goes before its attributes
+			element.text = strings.SplitN(element.text, ":", 2)[0]
+			fields = append(fields, element)
+		case "L":
+			labels = append(labels, element)
+		}
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].x < labels[j].x
+	})
+
+	result := make(map[string]string)
+	for _, field := range fields {
+		// Labels of the field are placed between the previous field on the same row and the field itself;
+		// widths of fields are unreliable, they could overlap labels of the next field
+		var start int
+		for _, other := range fields {
+			if other.y == field.y && other.x < field.x && other.x > start {
+				start = other.x
+			}
+		}
+
+		var words []string
+		for _, label := range labels {
+			if label.y == field.y && label.x > start && label.x+label.width <= field.x {
+				words = append(words, label.text)
+			}
+		}
+
+		if len(words) > 0 {
+			result[field.text] = strings.TrimSuffix(strings.Join(words, " "), ":")
+		}
+	}
+
+	return result
+}
+
+// SetNotifyKeyField sets the key field sent with the first message of call notification and preview events.
+// There can be only one key field, each call replaces the previous one; other fields are requested by SetDataField.
 func (c *Client) SetNotifyKeyField(ctx context.Context, listType ListType, fieldName string) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTSetNotifyKeyField", newArg("list_type", string([]byte{byte(listType)})), newArg("field_name", fieldName))
 	defer c.destroyCommand(invokeID)
@@ -296,7 +860,14 @@ func (c *Client) SetNotifyKeyField(ctx context.Context, listType ListType, field
 	return nil
 }
 
+// SetDataField adds the field to the data sent with call notification and preview events,
+// so only the fields the agent application cares about are sent.
+// The list type is checked before the command is sent, ErrInvalidListType is returned for unknown ones.
 func (c *Client) SetDataField(ctx context.Context, listType ListType, fieldName string) error {
+	if !listType.IsValid() {
+		return fmt.Errorf("%w: %q", ErrInvalidListType, byte(listType))
+	}
+
 	r, invokeID, err := c.invokeCommand(ctx, "AGTSetDataField", newArg("list_type", string([]byte{byte(listType)})), newArg("field_name", fieldName))
 	defer c.destroyCommand(invokeID)
 	if err != nil {
@@ -310,6 +881,65 @@ func (c *Client) SetDataField(ctx context.Context, listType ListType, fieldName
 	return nil
 }
 
+// SetDataFields adds several fields at once as SetDataField does. AGTSetDataField takes a single field,
+// so the commands are pipelined: all of them are written in order, which is the order of fields in call notification
+// and preview events, and only then their responses are waited for. Rejected fields are returned
+// as SetDataFieldsError, the rest of fields are added anyway. Unknown list types are rejected with ErrInvalidListType
+// before any command is sent.
+func (c *Client) SetDataFields(ctx context.Context, listType ListType, fieldNames ...string) error {
+	if !listType.IsValid() {
+		return fmt.Errorf("%w: %q", ErrInvalidListType, byte(listType))
+	}
+
+	type command struct {
+		name     string
+		r        *request
+		invokeID uint32
+		err      error
+	}
+
+	// Commands waiting for a slot would never get it while the earlier ones hold all slots,
+	// so no more commands are in flight than the limit of concurrent commands
+	window := len(fieldNames)
+	if c.commandSlots != nil && cap(c.commandSlots) < window {
+		window = cap(c.commandSlots)
+	}
+
+	fieldsErr := make(SetDataFieldsError)
+	finish := func(cmd command) {
+		defer c.destroyCommand(cmd.invokeID)
+		if cmd.err != nil {
+			fieldsErr[cmd.name] = fmt.Errorf("error while executing AGTSetDataField command: %w", cmd.err)
+			return
+		}
+		if _, err := processRequest(cmd.r); err != nil {
+			fieldsErr[cmd.name] = err
+		}
+	}
+
+	inflight := make([]command, 0, window)
+	for _, name := range fieldNames {
+		if len(inflight) == window {
+			finish(inflight[0])
+			inflight = inflight[1:]
+		}
+
+		r, invokeID, err := c.invokeCommand(ctx, "AGTSetDataField", newArg("list_type", string([]byte{byte(listType)})), newArg("field_name", name))
+		inflight = append(inflight, command{name: name, r: r, invokeID: invokeID, err: err})
+	}
+	for _, cmd := range inflight {
+		finish(cmd)
+	}
+
+	if len(fieldsErr) > 0 {
+		return fieldsErr
+	}
+
+	return nil
+}
+
+// AvailWork makes the agent available for work on the attached job, i.e. logs the agent on to it;
+// calls are still not delivered until ReadyNextItem.
 func (c *Client) AvailWork(ctx context.Context) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTAvailWork")
 	defer c.destroyCommand(invokeID)
@@ -320,10 +950,44 @@ func (c *Client) AvailWork(ctx context.Context) error {
 	if _, err := processRequest(r); err != nil {
 		return err
 	}
+	c.available.Store(true)
 
 	return nil
 }
 
+// Avail makes the agent available for work on the attached job again after Unavail, it's AvailWork
+// that is a no-op if the agent is already available.
+func (c *Client) Avail(ctx context.Context) error {
+	if c.available.Load() {
+		return nil
+	}
+
+	return c.AvailWork(ctx)
+}
+
+// Unavail makes the agent temporarily unavailable for work, the job stays attached and Avail undoes it.
+// Agent API has no separate command for that, so it's NoFurtherWork: the agent stops after the current record.
+// It's a no-op if the agent isn't available.
+func (c *Client) Unavail(ctx context.Context) error {
+	if !c.available.Load() {
+		return nil
+	}
+
+	return c.NoFurtherWork(ctx)
+}
+
+// Available tells whether the agent is available for work on the attached job as far as the client knows,
+// i.e. AvailWork has succeeded and neither NoFurtherWork nor DetachJob has succeeded since.
+func (c *Client) Available() bool {
+	return c.available.Load()
+}
+
+// ReadyNextItem makes the agent ready for the next customer record. Readiness lasts for a single record only:
+// after FinishedItem the agent stays not ready until the next ReadyNextItem, so a break is simply not calling it.
+// Agent API has no not-ready reason codes, the server only knows whether the agent is ready or not.
+// AGTReadyNextItem takes no arguments either, so the agent can't ask for a particular item: the dialer picks it,
+// out of the lists allowed by the work class (see SetWorkClass), while agent-owned recalls (see ScheduleCallback)
+// come when they are due.
 func (c *Client) ReadyNextItem(ctx context.Context) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTReadyNextItem")
 	defer c.destroyCommand(invokeID)
@@ -338,26 +1002,29 @@ func (c *Client) ReadyNextItem(ctx context.Context) error {
 	return nil
 }
 
+// ListKeys returns call completion codes of the attached job, every key is formatted as "code,description,label"
+// where label is the telephone script label. AGTListKeys has no list type, data field names of a list are
+// returned by ListDataFields instead.
 func (c *Client) ListKeys(ctx context.Context) ([]string, error) {
-	r, invokeID, err := c.invokeCommand(ctx, "AGTListKeys")
-	defer c.destroyCommand(invokeID)
-	if err != nil {
-		return nil, fmt.Errorf("error while executing AGTListKeys command: %w", err)
-	}
-
-	rawSegments, err := processRequest(r)
+	rawSegments, err := c.query(ctx, "AGTListKeys")
 	if err != nil {
 		return nil, err
 	}
 
 	keys := make([]string, 0, len(rawSegments))
 	for _, segment := range rawSegments {
+		// Every data message starts with its code, it's not a key
+		if segment == "M00001" {
+			continue
+		}
 		keys = append(keys, segment)
 	}
 
 	return keys, nil
 }
 
+// ReleaseLine releases the telephone line separately from the customer record, so the agent could continue updating
+// the record after the conversation is over; the record itself is released by FinishedItem.
 func (c *Client) ReleaseLine(ctx context.Context) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTReleaseLine")
 	defer c.destroyCommand(invokeID)
@@ -372,6 +1039,36 @@ func (c *Client) ReleaseLine(ctx context.Context) error {
 	return nil
 }
 
+// HangupCall disconnects the customer call but, unlike ReleaseLine, keeps the agent telephone line open,
+// e.g. to place a manual call afterwards. It returns ErrNoCall if there is no call to hang up.
+func (c *Client) HangupCall(ctx context.Context) error {
+	r, invokeID, err := c.invokeCommand(ctx, "AGTHangupCall")
+	defer c.destroyCommand(invokeID)
+	if err != nil {
+		return fmt.Errorf("error while executing AGTHangupCall command: %w", err)
+	}
+
+	if _, err := processRequest(r); err != nil {
+		if errors.Is(err, APCError{Code: "E28866"}) {
+			return fmt.Errorf("%w: %w", ErrNoCall, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Completion codes of Sales Verification jobs. There is no verification list type or work class in Agent API:
+// those jobs use outbound calling lists and outbound agents, so their records are read with ListTypeOutbound,
+// while the verification result is told by the completion code passed to FinishedItem.
+const (
+	CompCodeSold       = 93
+	CompCodeVerified   = 94
+	CompCodeUnverified = 95
+)
+
+// FinishedItem releases the customer record with the completion code, which is what Proactive Contact reports
+// the agent work by; valid codes of the attached job are returned by ListKeys.
 func (c *Client) FinishedItem(ctx context.Context, compCode int) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTFinishedItem", newArg("comp_code", strconv.Itoa(compCode)))
 	defer c.destroyCommand(invokeID)
@@ -382,20 +1079,63 @@ func (c *Client) FinishedItem(ctx context.Context, compCode int) error {
 	if _, err := processRequest(r); err != nil {
 		return err
 	}
+	if c.fieldCache != nil {
+		c.fieldCache.next()
+	}
 
 	return nil
 }
 
+// NoFurtherWork logs the agent out of the attached job, the job stays attached; AvailWork logs the agent back on.
+// If the agent is working on a record, the logout is held until FinishedItem, and one more call or preview
+// could still arrive while it's pending. It's the same as NoFurtherWorkOpts with zero NoFurtherWorkOptions,
+// i.e. the agent stops after the current record.
 func (c *Client) NoFurtherWork(ctx context.Context) error {
+	return c.NoFurtherWorkOpts(ctx, NoFurtherWorkOptions{})
+}
+
+// NoFurtherWorkOptions tell NoFurtherWorkOpts when the agent stops working.
+// AGTNoFurtherWork itself has no options: the server always waits for the current record to be finished.
+type NoFurtherWorkOptions struct {
+	// Immediate finishes the current record with CompCode right after the logout is requested,
+	// which also ends the call, instead of waiting for the agent to call FinishedItem
+	Immediate bool
+	// CompCode is the completion code the current record is finished with in the Immediate mode
+	CompCode int
+}
+
+// NoFurtherWorkOpts logs the agent out of the attached job either after the current record (by default)
+// or immediately. In the latter case the logout is requested first, so no new call or preview could arrive,
+// then the record is released with FinishedItem; having no record to release is fine.
+// If FinishedItem fails, its error is returned and the logout stays pending on the server.
+func (c *Client) NoFurtherWorkOpts(ctx context.Context, opts NoFurtherWorkOptions) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTNoFurtherWork")
 	defer c.destroyCommand(invokeID)
 	if err != nil {
 		return fmt.Errorf("error while executing AGTNoFurtherWork command: %w", err)
 	}
+	// The server holds the response until the record is finished, FinishedItem must not wait for this slot
+	c.releaseSlot(r)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := processRequest(r)
+		done <- err
+	}()
+
+	// E28919 means there is no record, so the logout isn't held
+	if opts.Immediate {
+		if err := c.FinishedItem(ctx, opts.CompCode); err != nil && !errors.Is(err, APCError{Code: "E28919"}) {
+			r.cancel()
+			<-done
+			return err
+		}
+	}
 
-	if _, err := processRequest(r); err != nil {
+	if err := <-done; err != nil {
 		return err
 	}
+	c.available.Store(false)
 
 	return nil
 }
@@ -410,40 +1150,94 @@ func (c *Client) DetachJob(ctx context.Context) error {
 	if _, err := processRequest(r); err != nil {
 		return err
 	}
+	c.available.Store(false)
 
 	return nil
 }
 
-func (c *Client) DisconnectHeadset(ctx context.Context) error {
-	r, invokeID, err := c.invokeCommand(ctx, "AGTDisconnHeadset")
-	defer c.destroyCommand(invokeID)
-	if err != nil {
-		return fmt.Errorf("error while executing AGTDisconnHeadset command: %w", err)
-	}
+// disconnectHeadsetRetry retries AGTDisconnHeadset rejected with E28877 while the server is still busy
+// with the previous disconnect, e.g. the one forced by the end of a call.
+var disconnectHeadsetRetry = RetryPolicy{MaxAttempts: 3, Backoff: 100 * time.Millisecond, Codes: []string{"E28877"}}
 
-	if _, err := processRequest(r); err != nil {
+// DisconnectHeadset closes the headset connection. AGTDisconnHeadset is always sent, even if HeadsetStatus
+// tells the headset isn't connected: the tracked state could be stale, e.g. after a reconnect. The server's answers
+// that there is no headset to disconnect (E28873, E28876) are treated as success.
+// The command is retried a few times while another disconnect is pending, unless ctx is done earlier.
+func (c *Client) DisconnectHeadset(ctx context.Context) error {
+	// E28873: headset is not reserved, E28876: headset is not connected
+	_, err := c.executeRetry(ctx, disconnectHeadsetRetry, "AGTDisconnHeadset")
+	if err != nil && !errors.Is(err, APCError{Code: "E28873"}) && !errors.Is(err, APCError{Code: "E28876"}) {
 		return err
 	}
+	c.headset.CompareAndSwap(uint32(HeadsetConnected), uint32(HeadsetReserved))
 
 	return nil
 }
 
+// FreeHeadset frees the disconnected headset, it's a no-op if there is no reserved headset
+// and ErrHeadsetConnected if the headset hasn't been disconnected yet. A headset that has been reserved,
+// but never connected is freed right away.
 func (c *Client) FreeHeadset(ctx context.Context) error {
+	if c.HeadsetStatus() == HeadsetConnected {
+		return ErrHeadsetConnected
+	}
+
 	r, invokeID, err := c.invokeCommand(ctx, "AGTFreeHeadset")
 	defer c.destroyCommand(invokeID)
 	if err != nil {
 		return fmt.Errorf("error while executing AGTFreeHeadset command: %w", err)
 	}
 
-	if _, err := processRequest(r); err != nil {
+	// E28873: there is no headset reserved
+	if _, err := processRequest(r); err != nil && !errors.Is(err, APCError{Code: "E28873"}) {
+		// E28879: the headset is not disconnected
+		if errors.Is(err, APCError{Code: "E28879"}) {
+			return fmt.Errorf("%w: %w", ErrHeadsetConnected, err)
+		}
 		return err
 	}
+	c.headset.Store(uint32(HeadsetFree))
+	c.headsetID.Store(0)
 
 	return nil
 }
 
-// Logoff sends ATGLogoff command, then Proactive Control server terminates session
+// Logoff sends ATGLogoff command, then Proactive Control server terminates session.
+// It's the same as LogoffOpts with zero LogoffOptions: if a job is still attached, possibly with a call
+// in progress, the server rejects the logoff and ErrPendingWork is returned.
 func (c *Client) Logoff(ctx context.Context) error {
+	return c.LogoffOpts(ctx, LogoffOptions{})
+}
+
+// LogoffOptions tell LogoffOpts how to deal with the work the agent still has.
+type LogoffOptions struct {
+	// Force finishes the pending work instead of failing with ErrPendingWork: the current record, if any,
+	// is finished with CompCode, which also ends the call, then the job is detached and the logoff is retried
+	Force bool
+	// CompCode is the completion code the current record is finished with if Force is set
+	CompCode int
+}
+
+// LogoffOpts logs the agent off. AGTLogoff is rejected while a job is attached, then ErrPendingWork is returned,
+// unless Force is set: the agent leaves the job immediately (see NoFurtherWorkOpts), the job is detached
+// and the logoff is sent again.
+func (c *Client) LogoffOpts(ctx context.Context, opts LogoffOptions) error {
+	err := c.logoff(ctx)
+	if !errors.Is(err, ErrPendingWork) || !opts.Force {
+		return err
+	}
+
+	if err := c.NoFurtherWorkOpts(ctx, NoFurtherWorkOptions{Immediate: true, CompCode: opts.CompCode}); err != nil {
+		return err
+	}
+	if err := c.DetachJob(ctx); err != nil {
+		return err
+	}
+
+	return c.logoff(ctx)
+}
+
+func (c *Client) logoff(ctx context.Context) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTLogoff")
 	defer c.destroyCommand(invokeID)
 	if err != nil {
@@ -451,12 +1245,17 @@ func (c *Client) Logoff(ctx context.Context) error {
 	}
 
 	if _, err := processRequest(r); err != nil {
+		// E28916: there is a job attached
+		if errors.Is(err, APCError{Code: "E28916"}) {
+			return fmt.Errorf("%w: %w", ErrPendingWork, err)
+		}
 		return err
 	}
 
 	return nil
 }
 
+// EchoOn turns on echoing of commands by the agent binary, it's on when the agent binary starts.
 func (c *Client) EchoOn(ctx context.Context) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTEchoOn")
 	defer c.destroyCommand(invokeID)
@@ -467,10 +1266,12 @@ func (c *Client) EchoOn(ctx context.Context) error {
 	if _, err := processRequest(r); err != nil {
 		return err
 	}
+	c.echo.Store(true)
 
 	return nil
 }
 
+// EchoOff turns off echoing of commands by the agent binary.
 func (c *Client) EchoOff(ctx context.Context) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTEchoOff")
 	defer c.destroyCommand(invokeID)
@@ -481,10 +1282,18 @@ func (c *Client) EchoOff(ctx context.Context) error {
 	if _, err := processRequest(r); err != nil {
 		return err
 	}
+	c.echo.Store(false)
 
 	return nil
 }
 
+// EchoMode reports whether echoing is on as it was last set by EchoOn or EchoOff.
+func (c *Client) EchoMode() bool {
+	return c.echo.Load()
+}
+
+// LogIoStart makes the agent binary write all messages of the session into <AgentName>_API.trans file
+// on the Proactive Contact system; it's a debugging aid, not an agent activity log.
 func (c *Client) LogIoStart(ctx context.Context) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTLogIoStart")
 	defer c.destroyCommand(invokeID)
@@ -499,6 +1308,7 @@ func (c *Client) LogIoStart(ctx context.Context) error {
 	return nil
 }
 
+// LogIoStop stops writing the transaction file started by LogIoStart.
 func (c *Client) LogIoStop(ctx context.Context) error {
 	r, invokeID, err := c.invokeCommand(ctx, "AGTLogIoStop")
 	defer c.destroyCommand(invokeID)
@@ -513,6 +1323,25 @@ func (c *Client) LogIoStop(ctx context.Context) error {
 	return nil
 }
 
+// DumpData makes the agent binary dump its memory structures (flags, state and variable settings)
+// into <AgentName>_<fileName>.dmp file on the Proactive Contact system; it's a troubleshooting aid.
+// The dump itself isn't sent back, vary the file name to keep several dumps of a session.
+// Agent API has no command that returns a dump or all fields of a record either, so there is nothing to stream;
+// read the fields needed with ReadFields.
+func (c *Client) DumpData(ctx context.Context, fileName string) error {
+	r, invokeID, err := c.invokeCommand(ctx, "AGTDumpData", newArg("file_name", fileName))
+	defer c.destroyCommand(invokeID)
+	if err != nil {
+		return fmt.Errorf("error while executing AGTDumpData command: %w", err)
+	}
+
+	if _, err := processRequest(r); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 type State struct {
 	Type    StateType
 	JobName string
@@ -529,13 +1358,7 @@ const (
 )
 
 func (c *Client) ListState(ctx context.Context) (*State, error) {
-	r, invokeID, err := c.invokeCommand(ctx, "AGTListState")
-	defer c.destroyCommand(invokeID)
-	if err != nil {
-		return nil, fmt.Errorf("error while executing AGTListState command: %w", err)
-	}
-
-	rawSegments, err := processRequest(r)
+	rawSegments, err := c.query(ctx, "AGTListState")
 	if err != nil {
 		return nil, err
 	}
@@ -560,6 +1383,27 @@ func (c *Client) ListState(ctx context.Context) (*State, error) {
 	}, nil
 }
 
+// LastResponse returns raw events of the most recently finished command as they were received:
+// pending, data and the final response ones. It's meant for debugging of responses that can't be parsed;
+// note that any command counts, including keepalive ones (see WithKeepalive).
+func (c *Client) LastResponse() []Event {
+	c.lastResponseMu.Lock()
+	defer c.lastResponseMu.Unlock()
+
+	return append([]Event(nil), c.lastResponse...)
+}
+
+// Ping measures the round trip of AGTListState, a harmless query, through the normal request path;
+// it's meant for health checks. Unlike ListState, the server answer isn't parsed, so only the round trip matters.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if _, err := c.execute(ctx, "AGTListState"); err != nil {
+		return 0, err
+	}
+
+	return time.Since(start), nil
+}
+
 type Field struct {
 	Name   string
 	Type   FieldType
@@ -571,20 +1415,45 @@ type FieldType string
 
 const (
 	FieldTypeAlphanumeric FieldType = "A"
-	FieldTypeNumeric      FieldType = "N"
-	FieldTypeDate         FieldType = "D"
-	FieldTypeCurrency     FieldType = "$"
-	FieldTypeFutureUse    FieldType = "F"
+	// FieldTypeCharacter is the same as FieldTypeAlphanumeric, but ListDataFields and ListCallFields report it as C
+	FieldTypeCharacter FieldType = "C"
+	FieldTypeNumeric   FieldType = "N"
+	FieldTypeDate      FieldType = "D"
+	FieldTypeTime      FieldType = "T"
+	FieldTypeCurrency  FieldType = "$"
+	FieldTypeFutureUse FieldType = "F"
 )
 
+// ReadField reads the field of the current customer record from the calling list of the given type;
+// the server answers E28892 or E28893 if the attached job has no list of that type.
+// With WithFieldCache the field is read from the cache if it has been read recently.
+// Unknown list types are rejected with ErrInvalidListType before the command is sent.
 func (c *Client) ReadField(ctx context.Context, listType ListType, fieldName string) (*Field, error) {
-	r, invokeID, err := c.invokeCommand(ctx, "AGTReadField", newArg("list_type", string([]byte{byte(listType)})), newArg("field_name", fieldName))
-	defer c.destroyCommand(invokeID)
+	if !listType.IsValid() {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidListType, byte(listType))
+	}
+
+	if c.fieldCache == nil {
+		return c.readField(ctx, listType, fieldName)
+	}
+
+	if field, ok := c.fieldCache.get(listType, fieldName); ok {
+		return field, nil
+	}
+
+	// The record could change while the field is being read, then it isn't cached
+	record := c.fieldCache.current()
+	field, err := c.readField(ctx, listType, fieldName)
 	if err != nil {
-		return nil, fmt.Errorf("error while executing AGTSetDataField command: %w", err)
+		return nil, err
 	}
+	c.fieldCache.put(listType, record, fieldName, field)
+
+	return field, nil
+}
 
-	rawSegments, err := processRequest(r)
+func (c *Client) readField(ctx context.Context, listType ListType, fieldName string) (*Field, error) {
+	rawSegments, err := c.query(ctx, "AGTReadField", newArg("list_type", string([]byte{byte(listType)})), newArg("field_name", fieldName))
 	if err != nil {
 		return nil, err
 	}
@@ -597,6 +1466,10 @@ func (c *Client) ReadField(ctx context.Context, listType ListType, fieldName str
 	if len(parts) != 4 {
 		return nil, fmt.Errorf("invalid segment")
 	}
+	// The response must be the one to this command, not a late one of another field
+	if !strings.EqualFold(parts[0], fieldName) {
+		return nil, fmt.Errorf("response has field %s, want %s", parts[0], fieldName)
+	}
 
 	length, err := strconv.Atoi(parts[2])
 	if err != nil {
@@ -610,3 +1483,410 @@ func (c *Client) ReadField(ctx context.Context, listType ListType, fieldName str
 		Value:  parts[3],
 	}, nil
 }
+
+// ReadFieldRaw reads the field of the current customer record like ReadField, but returns the value as it's received,
+// without the decoder (see WithDecoder), e.g. for fields that carry binary or already encoded data.
+// The value isn't cached even with WithFieldCache.
+func (c *Client) ReadFieldRaw(ctx context.Context, listType ListType, fieldName string) ([]byte, error) {
+	if !listType.IsValid() {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidListType, byte(listType))
+	}
+
+	r, invokeID, err := c.invokeCommand(ctx, "AGTReadField", newArg("list_type", string([]byte{byte(listType)})), newArg("field_name", fieldName))
+	defer c.destroyCommand(invokeID)
+	if err != nil {
+		return nil, fmt.Errorf("error while executing AGTReadField command: %w", err)
+	}
+
+	if _, err := processRequest(r); err != nil {
+		return nil, err
+	}
+
+	for _, event := range r.events {
+		if !event.IsDataMessage() || len(event.Segments) != 3 || event.Segments[1] != "M00001" {
+			continue
+		}
+
+		// The value is the last part, so it could contain commas itself
+		parts := bytes.SplitN(event.rawSegment(2), []byte(","), 4)
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid segment")
+		}
+		// The response must be the one to this command, not a late one of another field
+		if !bytes.EqualFold(parts[0], []byte(fieldName)) {
+			return nil, fmt.Errorf("response has field %s, want %s", parts[0], fieldName)
+		}
+
+		return parts[3], nil
+	}
+
+	return nil, fmt.Errorf("invalid segment")
+}
+
+// UpdateField writes the value into the field of the current customer record. The value must fit the length
+// and the type of the field (see ReadField and ListDataFields); it's sent through the encoder if any (see WithEncoder).
+// An unknown field is reported as ErrFieldNotFound.
+func (c *Client) UpdateField(ctx context.Context, listType ListType, fieldName string, value string) error {
+	r, invokeID, err := c.invokeCommand(ctx, "AGTUpdateField", newArg("list_type", string([]byte{byte(listType)})), newArg("field_name", fieldName), newArg("value", value))
+	defer c.destroyCommand(invokeID)
+	if err != nil {
+		return fmt.Errorf("error while executing AGTUpdateField command: %w", err)
+	}
+
+	if _, err := processRequest(r); err != nil {
+		if errors.Is(err, APCError{Code: "E28894"}) {
+			return fmt.Errorf("%w: %s: %w", ErrFieldNotFound, fieldName, err)
+		}
+		return err
+	}
+	if c.fieldCache != nil {
+		c.fieldCache.drop(listType, fieldName)
+	}
+
+	return nil
+}
+
+// MaxMessageLength is the maximum length of the message sent to a supervisor, in characters:
+// it's displayed on a single line of the supervisor screen.
+const MaxMessageLength = 79
+
+// SendMessage sends the message to the supervisor screen; the message is sent through the encoder if any
+// (see WithEncoder). Messages longer than MaxMessageLength are rejected with ErrMessageTooLong.
+func (c *Client) SendMessage(ctx context.Context, text string) error {
+	if n := utf8.RuneCountInString(text); n > MaxMessageLength {
+		return fmt.Errorf("%w: %d characters, up to %d allowed", ErrMessageTooLong, n, MaxMessageLength)
+	}
+
+	r, invokeID, err := c.invokeCommand(ctx, "AGTSendMessage", newArg("message", text))
+	defer c.destroyCommand(invokeID)
+	if err != nil {
+		return fmt.Errorf("error while executing AGTSendMessage command: %w", err)
+	}
+
+	if _, err := processRequest(r); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CompCodeAgentOwnedRecall is the completion code that releases a customer record as an Agent Owned Recall.
+const CompCodeAgentOwnedRecall = 98
+
+// APCTimeLayout is the layout of the date and the time of AGTSetCallback joined by a space: Proactive Contact uses
+// 10-character dates with 4-digit years and 24-hour HHMM times without a colon and seconds, see FormatAPCTime.
+const APCTimeLayout = "2006/01/02 1504"
+
+// FormatAPCTime formats the wall clock of t in its own location, it isn't converted to any other one:
+// the recall time is the time of day at the called party location, Proactive Contact schedules the recall
+// for the time zone of the phone by itself. So t should be in the location of the customer, if it's known.
+// Seconds are dropped.
+func FormatAPCTime(t time.Time) string {
+	return t.Format(APCTimeLayout)
+}
+
+// ParseAPCTime parses the date and the time formatted by FormatAPCTime. They carry no time zone,
+// so the wall clock is returned in UTC as time.Parse does; see ParseAPCTimeIn to put it into the called party location.
+func ParseAPCTime(s string) (time.Time, error) {
+	return ParseAPCTimeIn(s, time.UTC)
+}
+
+// ParseAPCTimeIn parses the date and the time formatted by FormatAPCTime as the wall clock in loc.
+// A wall clock repeated when daylight saving time ends is taken as the first of the two instants,
+// one skipped when it begins is normalized as time.Date does.
+func ParseAPCTimeIn(s string, loc *time.Location) (time.Time, error) {
+	t, err := time.ParseInLocation(APCTimeLayout, s, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid recall time %q: %w", s, err)
+	}
+
+	return t, nil
+}
+
+// ScheduleCallback sets the recall time for the current customer record via AGTSetCallback.
+// The date and time are sent as the wall clock in the location of when (see FormatAPCTime), because
+// Proactive Contact adjusts the recall time for the called party time zone by itself. An empty phone means
+// the first phone field (PHONE1) of the record, otherwise it's the number to use for the recall.
+//
+// System recalls are placed to any available agent and the record still has to be finished by the caller,
+// while agent-owned recalls are routed back to this agent: the record is finished right away
+// with CompCodeAgentOwnedRecall.
+//
+// There is no CancelCallback counterpart: Agent API has no command to cancel a recall once it's set,
+// AGTSetCallback and AGTListCallbackFmt are the only recall commands, and the server has nothing to address
+// a scheduled recall by. It has to be cancelled on Proactive Contact itself, e.g. by the supervisor.
+func (c *Client) ScheduleCallback(ctx context.Context, when time.Time, phone string, agentOwned bool) error {
+	date, clock, _ := strings.Cut(FormatAPCTime(when), " ")
+	args := []arg{
+		newArg("date", date),
+		newArg("time", clock),
+		newArg("phone_index", "1"),
+	}
+	if phone != "" {
+		// Recall name is required when recall number is used, but it could be empty
+		args = append(args, newArg("recall_name", ""), newArg("recall_number", phone))
+	}
+
+	r, invokeID, err := c.invokeCommand(ctx, "AGTSetCallback", args...)
+	defer c.destroyCommand(invokeID)
+	if err != nil {
+		return fmt.Errorf("error while executing AGTSetCallback command: %w", err)
+	}
+
+	if _, err := processRequest(r); err != nil {
+		return err
+	}
+
+	if agentOwned {
+		return c.FinishedItem(ctx, CompCodeAgentOwnedRecall)
+	}
+
+	return nil
+}
+
+// CallbackFormat describes recalls of the attached job.
+type CallbackFormat struct {
+	// DateFormat is the date format of Proactive Contact, e.g. 1999/03/06
+	DateFormat string
+	// Phones is the number of phones of a customer record available for recall, phone indexes start from 1
+	Phones int
+}
+
+// ListCallbackFormat returns the recall format of the attached job via AGTListCallbackFmt.
+// Recalls are not available on inbound jobs, the server answers E28868 then.
+// Agent API has no command to list scheduled recalls, they are reported only when they are placed.
+func (c *Client) ListCallbackFormat(ctx context.Context) (*CallbackFormat, error) {
+	rawSegments, err := c.query(ctx, "AGTListCallbackFmt")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rawSegments) != 3 || rawSegments[0] != "M00001" {
+		return nil, fmt.Errorf("invalid segment")
+	}
+
+	phones, err := strconv.Atoi(strings.TrimSpace(rawSegments[2]))
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert number of phones: %w", err)
+	}
+
+	return &CallbackFormat{
+		DateFormat: rawSegments[1],
+		Phones:     phones,
+	}, nil
+}
+
+// WorkClass is the agent type; it must match the type of the attached job to get calls routed to the agent.
+type WorkClass byte
+
+const (
+	WorkClassInbound        WorkClass = 'I'
+	WorkClassOutbound       WorkClass = 'O'
+	WorkClassBlend          WorkClass = 'B'
+	WorkClassPersonToPerson WorkClass = 'P'
+	WorkClassManaged        WorkClass = 'M'
+)
+
+// SetWorkClass transmits the agent type to Proactive Contact, the default one is WorkClassOutbound.
+// It should be called between Logon and AvailWork; the server rejects it with APCError E28882
+// when the agent is already available for work.
+func (c *Client) SetWorkClass(ctx context.Context, class WorkClass) error {
+	switch class {
+	case WorkClassInbound, WorkClassOutbound, WorkClassBlend, WorkClassPersonToPerson, WorkClassManaged:
+	default:
+		return ErrInvalidWorkClass
+	}
+
+	r, invokeID, err := c.invokeCommand(ctx, "AGTSetWorkClass", newArg("class_id", string([]byte{byte(class)})))
+	defer c.destroyCommand(invokeID)
+	if err != nil {
+		return fmt.Errorf("error while executing AGTSetWorkClass command: %w", err)
+	}
+
+	if _, err := processRequest(r); err != nil {
+		return err
+	}
+	c.workClass.Store(uint32(class))
+
+	return nil
+}
+
+// CompCodeManagedCancel is the completion code of a Managed Dialing call cancelled by the agent.
+const CompCodeManagedCancel = 35
+
+// checkManaged returns ErrNotManaged if the agent has explicitly set a work class other than WorkClassManaged.
+func (c *Client) checkManaged() error {
+	if class := WorkClass(c.workClass.Load()); class != 0 && class != WorkClassManaged {
+		return ErrNotManaged
+	}
+
+	return nil
+}
+
+// managedError wraps Managed Dialing errors of the server into ErrNotManaged and ErrNotPreviewing.
+func managedError(err error) error {
+	switch {
+	case errors.Is(err, APCError{Code: "E28907"}):
+		return fmt.Errorf("%w: %w", ErrNotManaged, err)
+	case errors.Is(err, APCError{Code: "E28908"}):
+		return fmt.Errorf("%w: %w", ErrNotPreviewing, err)
+	}
+
+	return err
+}
+
+// PreviewRecord asks for the next customer record on a Managed Dialing job,
+// the record arrives as NotificationTypePreviewRecord notification.
+func (c *Client) PreviewRecord(ctx context.Context) error {
+	if err := c.checkManaged(); err != nil {
+		return err
+	}
+
+	return managedError(c.ReadyNextItem(ctx))
+}
+
+// DialRecord places the call to the previewed customer before the preview period elapses.
+// It returns ErrNotPreviewing if there is no record to dial.
+func (c *Client) DialRecord(ctx context.Context) error {
+	if err := c.checkManaged(); err != nil {
+		return err
+	}
+
+	r, invokeID, err := c.invokeCommand(ctx, "AGTManagedCall")
+	defer c.destroyCommand(invokeID)
+	if err != nil {
+		return fmt.Errorf("error while executing AGTManagedCall command: %w", err)
+	}
+
+	if _, err := processRequest(r); err != nil {
+		return managedError(err)
+	}
+
+	return nil
+}
+
+// CancelRecord releases the previewed customer record without placing a call,
+// it's only valid before the call is placed and requires preview cancellation to be enabled for the job.
+func (c *Client) CancelRecord(ctx context.Context) error {
+	if err := c.checkManaged(); err != nil {
+		return err
+	}
+
+	return managedError(c.FinishedItem(ctx, CompCodeManagedCancel))
+}
+
+// FieldsError is returned by ReadFields when some of the fields couldn't be read; it maps field names to errors.
+type FieldsError map[string]error
+
+func (e FieldsError) Error() string {
+	return "cannot read fields: " + joinFieldErrors(e)
+}
+
+// SetDataFieldsError is returned by SetDataFields when some of the fields were rejected;
+// it maps field names to errors.
+type SetDataFieldsError map[string]error
+
+func (e SetDataFieldsError) Error() string {
+	return "cannot set data fields: " + joinFieldErrors(e)
+}
+
+// joinFieldErrors formats errors of fields sorted by names.
+func joinFieldErrors(errs map[string]error) string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s: %v", name, errs[name]))
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// ReadFields reads several fields of the current customer record at once; AGTReadField commands are pipelined
+// instead of waiting for each response in turn. Values of successfully read fields are returned even if some
+// of the fields failed, in this case the error is FieldsError.
+func (c *Client) ReadFields(ctx context.Context, listType ListType, names ...string) (Fields, error) {
+	type result struct {
+		name  string
+		field *Field
+		err   error
+	}
+
+	results := make(chan result, len(names))
+	for _, name := range names {
+		go func(name string) {
+			field, err := c.ReadField(ctx, listType, name)
+			results <- result{name: name, field: field, err: err}
+		}(name)
+	}
+
+	values := make(Fields, len(names))
+	fieldsErr := make(FieldsError)
+	for range names {
+		res := <-results
+		if res.err != nil {
+			fieldsErr[res.name] = res.err
+			continue
+		}
+
+		values[res.name] = res.field.Value
+	}
+
+	if len(fieldsErr) > 0 {
+		return values, fieldsErr
+	}
+
+	return values, nil
+}
+
+// PhoneInfo is the phone of the customer record stored in the indexed fields of the standard calling list:
+// PHONE1, ZONEPHONE1 and PHONECNT1 for the first phone and so on; the index is the same as CURPHONE holds.
+type PhoneInfo struct {
+	Index int
+	// Number is the value of PHONE<Index>
+	Number string
+	// Zone is the time zone code of ZONEPHONE<Index>, empty if the list has no such field
+	Zone string
+	// Attempts is the number of calls to the phone in PHONECNT<Index>, zero if the list has no such field
+	Attempts int
+}
+
+// ReadPhoneField reads the phone with the index (starting from 1) of the current customer record.
+// Only the phone number field is required, the time zone and the attempt counter are optional.
+func (c *Client) ReadPhoneField(ctx context.Context, listType ListType, phoneIndex int) (PhoneInfo, error) {
+	if phoneIndex < 1 {
+		return PhoneInfo{}, fmt.Errorf("invalid phone index %d, want 1 or more", phoneIndex)
+	}
+
+	index := strconv.Itoa(phoneIndex)
+	number, zone, attempts := "PHONE"+index, "ZONEPHONE"+index, "PHONECNT"+index
+
+	fields, err := c.ReadFields(ctx, listType, number, zone, attempts)
+	var fieldsErr FieldsError
+	if errors.As(err, &fieldsErr) {
+		for name, err := range fieldsErr {
+			if name == number || !errors.Is(err, APCError{Code: "E28894"}) {
+				return PhoneInfo{}, fmt.Errorf("cannot read field %s: %w", name, err)
+			}
+		}
+	} else if err != nil {
+		return PhoneInfo{}, err
+	}
+
+	phone := PhoneInfo{
+		Index:  phoneIndex,
+		Number: fields.String(number),
+		Zone:   fields.String(zone),
+	}
+	if _, ok := fields[attempts]; ok {
+		if phone.Attempts, err = fields.Int(attempts); err != nil {
+			return PhoneInfo{}, err
+		}
+	}
+
+	return phone, nil
+}
@@ -0,0 +1,2383 @@
+package apc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/atomic"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestClient_CommandTimeout(t *testing.T) {
+	// Server never answers
+	s := newMockServer(t, nil)
+	c, _ := newTestClient(t, s, WithCommandTimeout(100*time.Millisecond))
+
+	start := time.Now()
+	err := c.AttachJob(context.Background(), "TEST_JOB")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AttachJob() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("AttachJob() returned after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestClient_CommandTimeout_ContextDeadline(t *testing.T) {
+	// Server never answers
+	s := newMockServer(t, nil)
+	c, _ := newTestClient(t, s, WithCommandTimeout(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := c.AttachJob(ctx, "TEST_JOB"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AttachJob() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestClient_CommandTimeout_LateResponse(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		switch cmd.Keyword {
+		case "AGTAttachJob":
+			// Respond after the command has timed out and its invoke ID is taken by the next one
+			time.Sleep(200 * time.Millisecond)
+			respondOK(conn, cmd)
+		case "AGTDetachJob":
+			conn.respond(cmd, "1", "E28885")
+		default:
+			respondOK(conn, cmd)
+		}
+	})
+	c, done := newTestClient(t, s, WithCommandTimeout(100*time.Millisecond))
+
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("AttachJob() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The late response of AGTAttachJob must not complete AGTDetachJob
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.DetachJob(ctx); !errors.Is(err, APCError{Code: "E28885"}) {
+		t.Errorf("DetachJob() error = %v, want E28885", err)
+	}
+
+	// The connection is kept
+	if err := c.Logon(ctx, "agent", "password"); err != nil {
+		t.Errorf("Logon() error = %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Errorf("Start() has returned %v after the command timeout", err)
+	default:
+	}
+}
+
+func TestClient_CommandTimeout_LateResponseSameKeyword(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if cmd.Segments[1] == "NAME" {
+			// Respond after the command has timed out
+			time.Sleep(200 * time.Millisecond)
+			conn.data(cmd, "0", "M00001", "NAME,C,10,Smith")
+		} else {
+			conn.data(cmd, "0", "M00001", "PHONE1,N,10,2032699002")
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s, WithCommandTimeout(100*time.Millisecond))
+
+	if _, err := c.ReadField(context.Background(), ListTypeOutbound, "NAME"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ReadField() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := c.DebugStats().Abandoned; got != 1 {
+		t.Errorf("DebugStats().Abandoned = %d, want 1", got)
+	}
+
+	// The invoke ID of the timed out command isn't reused, so the late response can't be taken for this one
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	field, err := c.ReadField(ctx, ListTypeOutbound, "PHONE1")
+	if err != nil {
+		t.Fatalf("ReadField() error = %v", err)
+	}
+	if field.Name != "PHONE1" || field.Value != "2032699002" {
+		t.Errorf("ReadField() = %+v, want PHONE1", field)
+	}
+
+	received := s.received()
+	if received[0].InvokeID == received[1].InvokeID {
+		t.Errorf("both commands have invoke ID %d, want different ones", received[0].InvokeID)
+	}
+
+	// The late response has released the invoke ID
+	if stats := c.DebugStats(); stats.Abandoned != 0 || stats.InvokeIDs != stats.FreeInvokeIDs {
+		t.Errorf("DebugStats() = %+v, want all invoke IDs released", stats)
+	}
+}
+
+func TestClient_ReadField_AnotherField(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.data(cmd, "0", "M00001", "NAME,C,10,Smith")
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	if _, err := c.ReadField(context.Background(), ListTypeOutbound, "PHONE1"); err == nil {
+		t.Error("ReadField() error = nil, want the response of another field rejected")
+	}
+	if _, err := c.ReadFieldRaw(context.Background(), ListTypeOutbound, "PHONE1"); err == nil {
+		t.Error("ReadFieldRaw() error = nil, want the response of another field rejected")
+	}
+}
+
+func TestClient_ScheduleCallback(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	when := time.Date(2002, time.March, 5, 18, 30, 0, 0, time.UTC)
+	if err := c.ScheduleCallback(context.Background(), when, "2107778888", false); err != nil {
+		t.Fatalf("ScheduleCallback() error = %v", err)
+	}
+
+	received := s.received()
+	if len(received) != 1 {
+		t.Fatalf("server received %d commands, want 1", len(received))
+	}
+
+	want := []string{"2002/03/05", "1830", "1", "", "2107778888"}
+	if got := received[0]; got.Keyword != "AGTSetCallback" || !reflect.DeepEqual(got.Segments, want) {
+		t.Errorf("server received %s %q, want AGTSetCallback %q", got.Keyword, got.Segments, want)
+	}
+}
+
+func TestClient_ScheduleCallback_AgentOwned(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	when := time.Date(2002, time.March, 5, 9, 5, 0, 0, time.UTC)
+	if err := c.ScheduleCallback(context.Background(), when, "", true); err != nil {
+		t.Fatalf("ScheduleCallback() error = %v", err)
+	}
+
+	received := s.received()
+	if len(received) != 2 {
+		t.Fatalf("server received %d commands, want 2", len(received))
+	}
+
+	if got, want := received[0].Segments, []string{"2002/03/05", "0905", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AGTSetCallback segments = %q, want %q", got, want)
+	}
+	if got, want := received[1].Segments, []string{"98"}; received[1].Keyword != "AGTFinishedItem" || !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %s %q, want AGTFinishedItem %q", received[1].Keyword, got, want)
+	}
+}
+
+func TestClient_ScheduleCallback_NoRecord(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.respond(cmd, "1", "E28919")
+	})
+	c, _ := newTestClient(t, s)
+
+	err := c.ScheduleCallback(context.Background(), time.Now(), "", true)
+
+	if !errors.Is(err, APCError{Code: "E28919"}) {
+		t.Errorf("ScheduleCallback() error = %v, want E28919", err)
+	}
+
+	// Record must not be finished when recall wasn't set
+	if got := s.keywords(); !reflect.DeepEqual(got, []string{"AGTSetCallback"}) {
+		t.Errorf("server received %v, want only AGTSetCallback", got)
+	}
+}
+
+func TestAPCTime_RoundTrip(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("LoadLocation() error = %v", err)
+	}
+
+	// Daylight saving time began on 2021/03/14 at 02:00 and ended on 2021/11/07 at 02:00
+	for _, tc := range []struct {
+		when time.Time
+		want string
+	}{
+		{time.Date(2021, time.March, 14, 1, 59, 0, 0, newYork), "2021/03/14 0159"},
+		{time.Date(2021, time.March, 14, 3, 0, 0, 0, newYork), "2021/03/14 0300"},
+		{time.Date(2021, time.March, 13, 18, 30, 0, 0, newYork), "2021/03/13 1830"},
+		{time.Date(2021, time.March, 15, 18, 30, 0, 0, newYork), "2021/03/15 1830"},
+		{time.Date(2021, time.November, 7, 0, 59, 0, 0, newYork), "2021/11/07 0059"},
+		{time.Date(2021, time.November, 7, 2, 0, 0, 0, newYork), "2021/11/07 0200"},
+		{time.Date(2021, time.November, 8, 9, 5, 0, 0, newYork), "2021/11/08 0905"},
+	} {
+		got := FormatAPCTime(tc.when)
+		if got != tc.want {
+			t.Errorf("FormatAPCTime(%v) = %q, want %q", tc.when, got, tc.want)
+		}
+
+		parsed, err := ParseAPCTimeIn(got, newYork)
+		if err != nil {
+			t.Fatalf("ParseAPCTimeIn(%q) error = %v", got, err)
+		}
+		if !parsed.Equal(tc.when) {
+			t.Errorf("ParseAPCTimeIn(%q) = %v, want %v", got, parsed, tc.when)
+		}
+	}
+
+	// 01:30 has happened twice on 2021/11/07, the first one is in daylight saving time
+	repeated, err := ParseAPCTimeIn("2021/11/07 0130", newYork)
+	if want := time.Date(2021, time.November, 7, 5, 30, 0, 0, time.UTC); err != nil || !repeated.Equal(want) {
+		t.Errorf("ParseAPCTimeIn() = %v, %v, want %v", repeated, err, want)
+	}
+
+	// The wall clock isn't converted, so the same instant is formatted differently in other locations
+	when := time.Date(2021, time.March, 14, 12, 0, 0, 0, newYork)
+	if got, want := FormatAPCTime(when.UTC()), "2021/03/14 1600"; got != want {
+		t.Errorf("FormatAPCTime() = %q in UTC, want %q", got, want)
+	}
+	if got, err := ParseAPCTime("2021/03/14 1200"); err != nil || !got.Equal(time.Date(2021, time.March, 14, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("ParseAPCTime() = %v, %v, want 12:00 UTC", got, err)
+	}
+}
+
+func TestParseAPCTime_Invalid(t *testing.T) {
+	for _, s := range []string{"", "2021/03/14 12:00", "14/03/2021 1200", "2021/03/14"} {
+		if _, err := ParseAPCTime(s); err == nil {
+			t.Errorf("ParseAPCTime(%q) error = nil, want invalid recall time", s)
+		}
+	}
+}
+
+func TestClient_ListCallbackFormat(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.data(cmd, "0", "M00001", "1999/03/06", "2")
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	format, err := c.ListCallbackFormat(context.Background())
+	if err != nil {
+		t.Fatalf("ListCallbackFormat() error = %v", err)
+	}
+
+	want := &CallbackFormat{DateFormat: "1999/03/06", Phones: 2}
+	if !reflect.DeepEqual(format, want) {
+		t.Errorf("ListCallbackFormat() = %+v, want %+v", format, want)
+	}
+}
+
+func TestClient_ListCallbackFormat_Inbound(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.respond(cmd, "1", "E28868")
+	})
+	c, _ := newTestClient(t, s)
+
+	if _, err := c.ListCallbackFormat(context.Background()); !errors.Is(err, APCError{Code: "E28868"}) {
+		t.Errorf("ListCallbackFormat() error = %v, want E28868", err)
+	}
+}
+
+func TestClient_SetWorkClass(t *testing.T) {
+	classes := []WorkClass{WorkClassInbound, WorkClassOutbound, WorkClassBlend, WorkClassPersonToPerson, WorkClassManaged}
+	for _, class := range classes {
+		t.Run(string([]byte{byte(class)}), func(t *testing.T) {
+			s := newMockServer(t, respondOK)
+			c, _ := newTestClient(t, s)
+
+			if err := c.SetWorkClass(context.Background(), class); err != nil {
+				t.Fatalf("SetWorkClass() error = %v", err)
+			}
+
+			received := s.received()
+			want := []string{string([]byte{byte(class)})}
+			if len(received) != 1 || received[0].Keyword != "AGTSetWorkClass" || !reflect.DeepEqual(received[0].Segments, want) {
+				t.Errorf("server received %v, want AGTSetWorkClass %q", received, want)
+			}
+		})
+	}
+}
+
+func TestClient_SetWorkClass_Rejected(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.respond(cmd, "1", "E28882")
+	})
+	c, _ := newTestClient(t, s)
+
+	err := c.SetWorkClass(context.Background(), WorkClassBlend)
+	if !errors.Is(err, APCError{Keyword: "AGTSetWorkClass", Code: "E28882"}) {
+		t.Errorf("SetWorkClass() error = %v, want E28882", err)
+	}
+}
+
+func TestClient_SetWorkClass_Invalid(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	if err := c.SetWorkClass(context.Background(), WorkClass('X')); err != ErrInvalidWorkClass {
+		t.Errorf("SetWorkClass() error = %v, want %v", err, ErrInvalidWorkClass)
+	}
+
+	if got := s.keywords(); len(got) != 0 {
+		t.Errorf("server received %v, want nothing", got)
+	}
+}
+
+func TestClient_AvailUnavail(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	steps := []struct {
+		fn        func(context.Context) error
+		available bool
+	}{
+		{c.Unavail, false},
+		{c.Avail, true},
+		{c.Avail, true},
+		{c.Unavail, false},
+		{c.Unavail, false},
+		{c.Avail, true},
+	}
+	for i, step := range steps {
+		if err := step.fn(context.Background()); err != nil {
+			t.Fatalf("step %d error = %v", i, err)
+		}
+		if got := c.Available(); got != step.available {
+			t.Errorf("Available() = %v after step %d, want %v", got, i, step.available)
+		}
+	}
+
+	// Repeated toggles are no-ops
+	want := []string{"AGTAvailWork", "AGTNoFurtherWork", "AGTAvailWork"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+
+	if err := c.DetachJob(context.Background()); err != nil {
+		t.Fatalf("DetachJob() error = %v", err)
+	}
+	if c.Available() {
+		t.Error("Available() = true after DetachJob()")
+	}
+}
+
+func TestClient_Unavail_Rejected(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if cmd.Keyword == "AGTNoFurtherWork" {
+			conn.respond(cmd, "1", "E28885")
+			return
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	if err := c.Avail(context.Background()); err != nil {
+		t.Fatalf("Avail() error = %v", err)
+	}
+	if err := c.Unavail(context.Background()); !errors.Is(err, APCError{Code: "E28885"}) {
+		t.Errorf("Unavail() error = %v, want E28885", err)
+	}
+	if !c.Available() {
+		t.Error("Available() = false after rejected Unavail()")
+	}
+}
+
+func TestClient_ListJobsFiltered(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.data(cmd, "0", "M00001", "B,blend1,I", "I,inbnd1,A", "O,outbnd,I", "O,outbnd2,A")
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	jobs, err := c.ListJobsFiltered(context.Background(), JobTypeAll, StatusTypeActive)
+	if err != nil {
+		t.Fatalf("ListJobsFiltered() error = %v", err)
+	}
+	want := []Job{
+		{Type: JobTypeInbound, Name: "inbnd1", Status: StatusTypeActive},
+		{Type: JobTypeOutbound, Name: "outbnd2", Status: StatusTypeActive},
+	}
+	if !reflect.DeepEqual(jobs, want) {
+		t.Errorf("ListJobsFiltered() = %v, want %v", jobs, want)
+	}
+
+	jobs, err = c.ListJobsFiltered(context.Background(), JobTypeAll, StatusTypeInactive)
+	if err != nil {
+		t.Fatalf("ListJobsFiltered() error = %v", err)
+	}
+	if len(jobs) != 2 || jobs[0].Name != "blend1" || jobs[1].Name != "outbnd" {
+		t.Errorf("ListJobsFiltered() = %v, want blend1 and outbnd", jobs)
+	}
+
+	// The filter is applied on the client side
+	for _, cmd := range s.received() {
+		if !reflect.DeepEqual(cmd.Segments, []string{"A"}) {
+			t.Errorf("server received %v, want job type only", cmd.Segments)
+		}
+	}
+}
+
+func TestClient_AttachJobOpts(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	opts := AttachOptions{WorkClass: WorkClassBlend, AutoAvail: true}
+	if err := c.AttachJobOpts(context.Background(), "TEST_JOB", opts); err != nil {
+		t.Fatalf("AttachJobOpts() error = %v", err)
+	}
+
+	received := s.received()
+	want := []string{"AGTSetWorkClass", "AGTAttachJob", "AGTAvailWork"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("server received %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(received[0].Segments, []string{"B"}) || !reflect.DeepEqual(received[1].Segments, []string{"TEST_JOB"}) {
+		t.Errorf("server received %v, want work class B and job TEST_JOB", received)
+	}
+}
+
+func TestClient_AttachJobOpts_Default(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	if err := c.AttachJobOpts(context.Background(), "TEST_JOB", AttachOptions{}); err != nil {
+		t.Fatalf("AttachJobOpts() error = %v", err)
+	}
+
+	if got, want := s.keywords(), []string{"AGTAttachJob"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_AttachJobOpts_WorkClassRejected(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.respond(cmd, "1", "E28882")
+	})
+	c, _ := newTestClient(t, s)
+
+	err := c.AttachJobOpts(context.Background(), "TEST_JOB", AttachOptions{WorkClass: WorkClassInbound, AutoAvail: true})
+	if !errors.Is(err, APCError{Keyword: "AGTSetWorkClass", Code: "E28882"}) {
+		t.Errorf("AttachJobOpts() error = %v, want E28882", err)
+	}
+
+	if got, want := s.keywords(), []string{"AGTSetWorkClass"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+// respondField is the mockHandler that answers AGTReadField with alphanumeric field values
+// like "value of NAME"; field BOGUS is unknown.
+func respondField(conn *mockConn, cmd Event) {
+	if cmd.Keyword != "AGTReadField" {
+		respondOK(conn, cmd)
+		return
+	}
+
+	name := cmd.Segments[1]
+	if name == "BOGUS" {
+		conn.respond(cmd, "1", "E28894")
+		return
+	}
+
+	conn.data(cmd, "0", "M00001", fmt.Sprintf("%s,A,20,value of %s", name, name))
+	respondOK(conn, cmd)
+}
+
+func TestClient_ReadField_ListTypes(t *testing.T) {
+	// An inbound job has no outbound calling list
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		switch ListType(cmd.Segments[0][0]) {
+		case ListTypeInbound:
+			conn.data(cmd, "0", "M00001", "CALLTIME,T,8,10:30:00")
+			respondOK(conn, cmd)
+		default:
+			conn.respond(cmd, "1", "E28893")
+		}
+	})
+	c, _ := newTestClient(t, s)
+
+	field, err := c.ReadField(context.Background(), ListTypeInbound, "CALLTIME")
+	if err != nil {
+		t.Fatalf("ReadField() error = %v", err)
+	}
+	want := &Field{Name: "CALLTIME", Type: FieldTypeTime, Length: 8, Value: "10:30:00"}
+	if !reflect.DeepEqual(field, want) {
+		t.Errorf("ReadField() = %+v, want %+v", field, want)
+	}
+
+	if _, err := c.ReadField(context.Background(), ListTypeOutbound, "CALLTIME"); !errors.Is(err, APCError{Code: "E28893"}) {
+		t.Errorf("ReadField() error = %v, want E28893", err)
+	}
+
+	commands := s.received()
+	if len(commands) != 2 || commands[0].Segments[0] != "I" || commands[1].Segments[0] != "O" {
+		t.Errorf("server received %v, want AGTReadField with list types I and O", commands)
+	}
+}
+
+func TestListType(t *testing.T) {
+	for _, tc := range []struct {
+		listType ListType
+		valid    bool
+		s        string
+	}{
+		{ListTypeOutbound, true, "outbound"},
+		{ListTypeInbound, true, "inbound"},
+		{ListType('X'), false, "unknown"},
+		{ListType(0), false, "unknown"},
+	} {
+		if got := tc.listType.IsValid(); got != tc.valid {
+			t.Errorf("ListType(%q).IsValid() = %v, want %v", byte(tc.listType), got, tc.valid)
+		}
+		if got := tc.listType.String(); got != tc.s {
+			t.Errorf("ListType(%q).String() = %q, want %q", byte(tc.listType), got, tc.s)
+		}
+	}
+}
+
+func TestClient_InvalidListType(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	if _, err := c.ReadField(context.Background(), ListType('X'), "NAME"); !errors.Is(err, ErrInvalidListType) {
+		t.Errorf("ReadField() error = %v, want %v", err, ErrInvalidListType)
+	}
+	if _, err := c.ReadFieldRaw(context.Background(), ListType('X'), "NAME"); !errors.Is(err, ErrInvalidListType) {
+		t.Errorf("ReadFieldRaw() error = %v, want %v", err, ErrInvalidListType)
+	}
+	if err := c.SetDataField(context.Background(), ListType('X'), "NAME"); !errors.Is(err, ErrInvalidListType) {
+		t.Errorf("SetDataField() error = %v, want %v", err, ErrInvalidListType)
+	}
+	if err := c.SetDataFields(context.Background(), ListType('X'), "NAME", "PHONE1"); !errors.Is(err, ErrInvalidListType) {
+		t.Errorf("SetDataFields() error = %v, want %v", err, ErrInvalidListType)
+	}
+	if got := s.keywords(); len(got) != 0 {
+		t.Errorf("server received %v, want nothing", got)
+	}
+
+	if err := c.SetDataField(context.Background(), ListTypeInbound, "NAME"); err != nil {
+		t.Errorf("SetDataField() error = %v", err)
+	}
+}
+
+// countKeyword returns how many times the server has received the command
+func countKeyword(s *mockServer, keyword string) int {
+	var n int
+	for _, k := range s.keywords() {
+		if k == keyword {
+			n++
+		}
+	}
+
+	return n
+}
+
+func TestClient_FieldCache(t *testing.T) {
+	s := newMockServer(t, respondField)
+	c, _ := newTestClient(t, s, WithFieldCache(100*time.Millisecond))
+
+	for i := 0; i < 3; i++ {
+		field, err := c.ReadField(context.Background(), ListTypeOutbound, "NAME")
+		if err != nil {
+			t.Fatalf("ReadField() error = %v", err)
+		}
+		if field.Value != "value of NAME" {
+			t.Errorf("ReadField() value = %q, want %q", field.Value, "value of NAME")
+		}
+	}
+	if _, err := c.ReadFields(context.Background(), ListTypeOutbound, "NAME"); err != nil {
+		t.Fatalf("ReadFields() error = %v", err)
+	}
+	if n := countKeyword(s, "AGTReadField"); n != 1 {
+		t.Errorf("server received %d AGTReadField, want 1 within the TTL", n)
+	}
+
+	// Inbound list is cached separately
+	if _, err := c.ReadField(context.Background(), ListTypeInbound, "NAME"); err != nil {
+		t.Fatalf("ReadField() error = %v", err)
+	}
+	if n := countKeyword(s, "AGTReadField"); n != 2 {
+		t.Errorf("server received %d AGTReadField, want 2 after reading another list", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, err := c.ReadField(context.Background(), ListTypeOutbound, "NAME"); err != nil {
+		t.Fatalf("ReadField() error = %v", err)
+	}
+	if n := countKeyword(s, "AGTReadField"); n != 3 {
+		t.Errorf("server received %d AGTReadField, want 3 after the TTL", n)
+	}
+}
+
+func TestClient_FieldCache_RecordChange(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		// The next record is delivered as soon as the agent is ready
+		if cmd.Keyword == "AGTReadyNextItem" {
+			conn.send("AGTCallNotify", EventTypeNotification, 0, "0", "M00001", "0000000001", "OUTBOUND")
+			conn.send("AGTCallNotify", EventTypeNotification, 0, "0", "M00001", "NAME,Jane Doe")
+			conn.send("AGTCallNotify", EventTypeNotification, 0, "0", "M00000")
+		}
+		respondField(conn, cmd)
+	})
+	c, _ := newTestClient(t, s, WithFieldCache(time.Hour))
+
+	notifications := c.Notifications(context.Background())
+	read := func() {
+		t.Helper()
+		if _, err := c.ReadField(context.Background(), ListTypeOutbound, "NAME"); err != nil {
+			t.Fatalf("ReadField() error = %v", err)
+		}
+	}
+
+	read()
+	if err := c.ReadyNextItem(context.Background()); err != nil {
+		t.Fatalf("ReadyNextItem() error = %v", err)
+	}
+	select {
+	case <-notifications:
+	case <-time.After(time.Second):
+		t.Fatal("call notification hasn't been delivered")
+	}
+	read()
+	if n := countKeyword(s, "AGTReadField"); n != 2 {
+		t.Errorf("server received %d AGTReadField, want 2 after the call notification", n)
+	}
+
+	if err := c.UpdateField(context.Background(), ListTypeOutbound, "NAME", "John Doe"); err != nil {
+		t.Fatalf("UpdateField() error = %v", err)
+	}
+	read()
+	if n := countKeyword(s, "AGTReadField"); n != 3 {
+		t.Errorf("server received %d AGTReadField, want 3 after the field is updated", n)
+	}
+
+	if err := c.FinishedItem(context.Background(), 20); err != nil {
+		t.Fatalf("FinishedItem() error = %v", err)
+	}
+	read()
+	if n := countKeyword(s, "AGTReadField"); n != 4 {
+		t.Errorf("server received %d AGTReadField, want 4 after the record is finished", n)
+	}
+}
+
+func TestClient_SalesVerification(t *testing.T) {
+	s := newMockServer(t, respondField)
+	c, _ := newTestClient(t, s)
+
+	// Only outbound agents can join Sales Verification jobs
+	if err := c.AttachJobOpts(context.Background(), "verify", AttachOptions{WorkClass: WorkClassOutbound, AutoAvail: true}); err != nil {
+		t.Fatalf("AttachJobOpts() error = %v", err)
+	}
+	if err := c.ReadyNextItem(context.Background()); err != nil {
+		t.Fatalf("ReadyNextItem() error = %v", err)
+	}
+	field, err := c.ReadField(context.Background(), ListTypeOutbound, "SALEAMT")
+	if err != nil {
+		t.Fatalf("ReadField() error = %v", err)
+	}
+	if field.Value != "value of SALEAMT" {
+		t.Errorf("ReadField() value = %q, want %q", field.Value, "value of SALEAMT")
+	}
+	if err := c.FinishedItem(context.Background(), CompCodeVerified); err != nil {
+		t.Fatalf("FinishedItem() error = %v", err)
+	}
+
+	received := s.received()
+	read, finished := received[len(received)-2], received[len(received)-1]
+	if read.Keyword != "AGTReadField" || !reflect.DeepEqual(read.Segments, []string{"O", "SALEAMT"}) {
+		t.Errorf("server received %v, want AGTReadField of outbound list", read)
+	}
+	if finished.Keyword != "AGTFinishedItem" || !reflect.DeepEqual(finished.Segments, []string{"94"}) {
+		t.Errorf("server received %v, want AGTFinishedItem 94", finished)
+	}
+}
+
+func TestClient_ReadFields(t *testing.T) {
+	s := newMockServer(t, respondField)
+	c, _ := newTestClient(t, s)
+
+	values, err := c.ReadFields(context.Background(), ListTypeOutbound, "DEBT_ID", "CURPHONE", "BOGUS", "PHONE1", "PHONE2")
+
+	var fieldsErr FieldsError
+	if !errors.As(err, &fieldsErr) {
+		t.Fatalf("ReadFields() error = %v, want FieldsError", err)
+	}
+	if len(fieldsErr) != 1 || !errors.Is(fieldsErr["BOGUS"], APCError{Code: "E28894"}) {
+		t.Errorf("ReadFields() error = %v, want only BOGUS failed", err)
+	}
+
+	want := Fields{
+		"DEBT_ID":  "value of DEBT_ID",
+		"CURPHONE": "value of CURPHONE",
+		"PHONE1":   "value of PHONE1",
+		"PHONE2":   "value of PHONE2",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("ReadFields() = %v, want %v", values, want)
+	}
+}
+
+func TestClient_DebugStats(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		held     []Event
+		heldConn *mockConn
+	)
+	// Commands are held until the test answers them
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		held = append(held, cmd)
+		heldConn = conn
+	})
+
+	var allocated, released atomic.Int32
+	c, _ := newTestClient(t, s, WithLogHandler(LogLevelDebug, func(entry LogEntry) {
+		switch entry.Message {
+		case "Invoke ID has allocated.":
+			allocated.Inc()
+		case "Invoke ID has released.":
+			released.Inc()
+		}
+	}))
+
+	const commands = 3
+	errs := make(chan error, commands)
+	for i := 0; i < commands; i++ {
+		go func() {
+			errs <- c.AvailWork(context.Background())
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(s.received()) < commands {
+		if time.Now().After(deadline) {
+			t.Fatalf("server received %d commands, want %d", len(s.received()), commands)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := c.DebugStats()
+	if stats.InFlight != commands || stats.InvokeIDs-stats.FreeInvokeIDs != commands {
+		t.Errorf("DebugStats() = %+v, want %d commands in flight holding invoke IDs", stats, commands)
+	}
+
+	mu.Lock()
+	for _, cmd := range held {
+		respondOK(heldConn, cmd)
+	}
+	mu.Unlock()
+	for i := 0; i < commands; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("AvailWork() error = %v", err)
+		}
+	}
+
+	stats = c.DebugStats()
+	if stats.InFlight != 0 || stats.InvokeIDs != stats.FreeInvokeIDs {
+		t.Errorf("DebugStats() = %+v, want no commands in flight and all invoke IDs free", stats)
+	}
+	if allocated.Load() != commands || released.Load() != commands {
+		t.Errorf("logged %d allocations and %d releases, want %d", allocated.Load(), released.Load(), commands)
+	}
+}
+
+func TestClient_ConcurrentCommands(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	const (
+		goroutines = 50
+		commands   = 10
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines*commands)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < commands; j++ {
+				errs <- c.AttachJob(context.Background(), fmt.Sprintf("JOB_%d_%d", i, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("AttachJob() error = %v", err)
+		}
+	}
+
+	// Server stops reading on the first malformed frame, so all commands must be decoded intact
+	received := s.received()
+	if len(received) != goroutines*commands {
+		t.Fatalf("server received %d commands, want %d", len(received), goroutines*commands)
+	}
+
+	jobs := make(map[string]bool, len(received))
+	for _, cmd := range received {
+		if cmd.Keyword != "AGTAttachJob" || len(cmd.Segments) != 1 {
+			t.Fatalf("server received malformed command %+v", cmd)
+		}
+		jobs[cmd.Segments[0]] = true
+	}
+	if len(jobs) != goroutines*commands {
+		t.Errorf("server received %d distinct jobs, want %d", len(jobs), goroutines*commands)
+	}
+}
+
+func TestClient_Tracing(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if cmd.Keyword == "AGTAttachJob" {
+			conn.respond(cmd, "1", "E28889")
+			return
+		}
+		respondOK(conn, cmd)
+	})
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	c, _ := newTestClient(t, s, WithTracerProvider(tp))
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	if err := c.Logon(ctx, "agent", "password"); err != nil {
+		t.Fatalf("Logon() error = %v", err)
+	}
+	if err := c.AttachJob(ctx, "TEST_JOB"); err == nil {
+		t.Fatal("AttachJob() error = nil, want E28889")
+	}
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("recorded %d spans, want 3", len(spans))
+	}
+
+	logon, attach := spans[0], spans[1]
+	if logon.Name() != "AGTLogon" || logon.SpanKind() != trace.SpanKindClient {
+		t.Errorf("span = %s %s, want AGTLogon client", logon.Name(), logon.SpanKind())
+	}
+	if logon.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("AGTLogon span parent = %s, want %s", logon.Parent().SpanID(), parent.SpanContext().SpanID())
+	}
+	if logon.Status().Code != codes.Unset {
+		t.Errorf("AGTLogon span status = %v, want unset", logon.Status())
+	}
+
+	wantAttrs := map[attribute.Key]attribute.Value{
+		"apc.keyword":   attribute.StringValue("AGTLogon"),
+		"apc.invoke_id": attribute.Int64Value(1),
+	}
+	for _, kv := range logon.Attributes() {
+		if want, ok := wantAttrs[kv.Key]; ok && kv.Value != want {
+			t.Errorf("AGTLogon span attribute %s = %v, want %v", kv.Key, kv.Value.Emit(), want.Emit())
+		}
+		delete(wantAttrs, kv.Key)
+	}
+	if len(wantAttrs) > 0 {
+		t.Errorf("AGTLogon span misses attributes %v", wantAttrs)
+	}
+
+	if attach.Name() != "AGTAttachJob" || attach.Status().Code != codes.Error {
+		t.Errorf("span = %s %v, want AGTAttachJob with error status", attach.Name(), attach.Status())
+	}
+}
+
+type fakeCollector struct {
+	mu            sync.Mutex
+	started       []string
+	finished      []string
+	errs          []error
+	notifications []NotificationType
+}
+
+func (f *fakeCollector) CommandStarted(keyword string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started = append(f.started, keyword)
+}
+
+func (f *fakeCollector) CommandFinished(keyword string, _ time.Duration, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.finished = append(f.finished, keyword)
+	f.errs = append(f.errs, err)
+}
+
+func (f *fakeCollector) NotificationReceived(notificationType NotificationType) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.notifications = append(f.notifications, notificationType)
+}
+
+func (f *fakeCollector) DecodeFailed() {}
+
+func TestClient_Metrics(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		switch cmd.Keyword {
+		case "AGTAttachJob":
+			conn.respond(cmd, "1", "E28889")
+		case "AGTAvailWork":
+			respondOK(conn, cmd)
+			conn.send("AGTAutoReleaseLine", EventTypeNotification, 0, "0", "M00000")
+		default:
+			respondOK(conn, cmd)
+		}
+	})
+
+	collector := &fakeCollector{}
+	c, _ := newTestClient(t, s, WithMetrics(collector))
+
+	notifications := c.Notifications(context.Background())
+
+	if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+		t.Fatalf("Logon() error = %v", err)
+	}
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); err == nil {
+		t.Fatal("AttachJob() error = nil, want E28889")
+	}
+	if err := c.AvailWork(context.Background()); err != nil {
+		t.Fatalf("AvailWork() error = %v", err)
+	}
+
+	select {
+	case <-notifications:
+	case <-time.After(time.Second):
+		t.Fatal("notification has not been received")
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+
+	want := []string{"AGTLogon", "AGTAttachJob", "AGTAvailWork"}
+	if !reflect.DeepEqual(collector.started, want) {
+		t.Errorf("started commands = %v, want %v", collector.started, want)
+	}
+	if !reflect.DeepEqual(collector.finished, want) {
+		t.Errorf("finished commands = %v, want %v", collector.finished, want)
+	}
+	if collector.errs[0] != nil || !errors.Is(collector.errs[1], APCError{Code: "E28889"}) || collector.errs[2] != nil {
+		t.Errorf("command errors = %v, want [nil E28889 nil]", collector.errs)
+	}
+	if want := []NotificationType{NotificationTypeAutoReleaseLine}; !reflect.DeepEqual(collector.notifications, want) {
+		t.Errorf("notifications = %v, want %v", collector.notifications, want)
+	}
+}
+
+func TestClient_HangupCall(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	if err := c.HangupCall(context.Background()); err != nil {
+		t.Fatalf("HangupCall() error = %v", err)
+	}
+
+	if got := s.keywords(); !reflect.DeepEqual(got, []string{"AGTHangupCall"}) {
+		t.Errorf("server received %v, want AGTHangupCall", got)
+	}
+}
+
+func TestClient_HangupCall_NoCall(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.respond(cmd, "1", "E28866")
+	})
+	c, _ := newTestClient(t, s)
+
+	err := c.HangupCall(context.Background())
+	if !errors.Is(err, ErrNoCall) {
+		t.Errorf("HangupCall() error = %v, want %v", err, ErrNoCall)
+	}
+	if !errors.Is(err, APCError{Code: "E28866"}) {
+		t.Errorf("HangupCall() error = %v, want E28866", err)
+	}
+}
+
+// failOnce returns the mockHandler that fails the first command w/ the keyword with the code and completes the rest.
+func failOnce(keyword, code string, data ...string) mockHandler {
+	var (
+		mu     sync.Mutex
+		failed bool
+	)
+
+	return func(conn *mockConn, cmd Event) {
+		mu.Lock()
+		fail := cmd.Keyword == keyword && !failed
+		if fail {
+			failed = true
+		}
+		mu.Unlock()
+
+		if fail {
+			conn.respond(cmd, "1", code)
+			return
+		}
+
+		if cmd.Keyword == keyword && len(data) > 0 {
+			conn.data(cmd, append([]string{"0"}, data...)...)
+		}
+		respondOK(conn, cmd)
+	}
+}
+
+func TestClient_CommandRetry(t *testing.T) {
+	s := newMockServer(t, failOnce("AGTListState", "E28866", "S70004"))
+	c, _ := newTestClient(t, s, WithCommandRetry(RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     10 * time.Millisecond,
+		Codes:       []string{"E28866"},
+	}))
+
+	state, err := c.ListState(context.Background())
+	if err != nil {
+		t.Fatalf("ListState() error = %v", err)
+	}
+	if state.Type != StateTypeLoggedOn {
+		t.Errorf("ListState() = %v, want %v", state.Type, StateTypeLoggedOn)
+	}
+
+	if got, want := s.keywords(), []string{"AGTListState", "AGTListState"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_CommandRetry_Mutation(t *testing.T) {
+	s := newMockServer(t, failOnce("AGTFinishedItem", "E28866"))
+	c, _ := newTestClient(t, s, WithCommandRetry(RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     10 * time.Millisecond,
+		Codes:       []string{"E28866"},
+	}))
+
+	if err := c.FinishedItem(context.Background(), 22); !errors.Is(err, APCError{Code: "E28866"}) {
+		t.Errorf("FinishedItem() error = %v, want E28866", err)
+	}
+
+	if got, want := s.keywords(), []string{"AGTFinishedItem"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_CommandRetry_NotRetryable(t *testing.T) {
+	s := newMockServer(t, failOnce("AGTListState", "E28885"))
+	c, _ := newTestClient(t, s, WithCommandRetry(RetryPolicy{
+		MaxAttempts: 3,
+		Codes:       []string{"E28866"},
+	}))
+
+	if _, err := c.ListState(context.Background()); !errors.Is(err, APCError{Code: "E28885"}) {
+		t.Errorf("ListState() error = %v, want E28885", err)
+	}
+
+	if got, want := s.keywords(), []string{"AGTListState"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_ListKeys(t *testing.T) {
+	keys := []string{
+		"35,Managed cancel call,cancel_call",
+		"89,Managed non-connection,call_complete",
+		",*Record not yet called,pf_msg_1",
+		"6,,call_complete",
+	}
+
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.data(cmd, append([]string{"0", "M00001"}, keys...)...)
+		conn.respond(cmd, "0", "M00000")
+	})
+	c, _ := newTestClient(t, s)
+
+	got, err := c.ListKeys(context.Background())
+	if err != nil {
+		t.Fatalf("ListKeys() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(got, keys) {
+		t.Errorf("ListKeys() = %v, want %v", got, keys)
+	}
+}
+
+func TestClient_ManagedDialing(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		switch cmd.Keyword {
+		case "AGTReadyNextItem":
+			respondOK(conn, cmd)
+			conn.send("AGTPreviewRecord", EventTypeNotification, 0, "0", "M00001", "JOHN DOE (Preview)", "MANAGED", "DEBT_ID,1005")
+			conn.send("AGTPreviewRecord", EventTypeNotification, 0, "0", "M00001", "CURPHONE,2037538811")
+			conn.send("AGTPreviewRecord", EventTypeNotification, 0, "0", "M00000")
+		case "AGTManagedCall":
+			conn.send(cmd.Keyword, EventTypePending, cmd.InvokeID, "0", "S28833")
+			conn.data(cmd, "0", "M00001", "(CONNECT)")
+			respondOK(conn, cmd)
+		default:
+			respondOK(conn, cmd)
+		}
+	})
+	c, _ := newTestClient(t, s)
+
+	notifications := c.Notifications(context.Background())
+
+	if err := c.SetWorkClass(context.Background(), WorkClassManaged); err != nil {
+		t.Fatalf("SetWorkClass() error = %v", err)
+	}
+	if err := c.PreviewRecord(context.Background()); err != nil {
+		t.Fatalf("PreviewRecord() error = %v", err)
+	}
+
+	select {
+	case n := <-notifications:
+		want := Notification{Type: NotificationTypePreviewRecord, Payload: map[string]string{"CURPHONE": "2037538811"}}
+		n.ReceivedAt = time.Time{}
+		if !reflect.DeepEqual(n, want) {
+			t.Errorf("notification = %#v, want %#v", n, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("preview record has not been received")
+	}
+
+	if err := c.DialRecord(context.Background()); err != nil {
+		t.Fatalf("DialRecord() error = %v", err)
+	}
+	if err := c.CancelRecord(context.Background()); err != nil {
+		t.Fatalf("CancelRecord() error = %v", err)
+	}
+
+	want := []string{"AGTSetWorkClass", "AGTReadyNextItem", "AGTManagedCall", "AGTFinishedItem"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+	if got := s.received()[3].Segments; !reflect.DeepEqual(got, []string{"35"}) {
+		t.Errorf("AGTFinishedItem segments = %v, want [35]", got)
+	}
+}
+
+func TestClient_ManagedDialing_NotManaged(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	if err := c.SetWorkClass(context.Background(), WorkClassOutbound); err != nil {
+		t.Fatalf("SetWorkClass() error = %v", err)
+	}
+
+	for name, fn := range map[string]func(context.Context) error{
+		"PreviewRecord": c.PreviewRecord,
+		"DialRecord":    c.DialRecord,
+		"CancelRecord":  c.CancelRecord,
+	} {
+		if err := fn(context.Background()); !errors.Is(err, ErrNotManaged) {
+			t.Errorf("%s() error = %v, want %v", name, err, ErrNotManaged)
+		}
+	}
+
+	if got := s.keywords(); !reflect.DeepEqual(got, []string{"AGTSetWorkClass"}) {
+		t.Errorf("server received %v, want only AGTSetWorkClass", got)
+	}
+}
+
+func TestClient_DialRecord_Rejected(t *testing.T) {
+	tests := []struct {
+		code string
+		want error
+	}{
+		{"E28907", ErrNotManaged},
+		{"E28908", ErrNotPreviewing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			s := newMockServer(t, func(conn *mockConn, cmd Event) {
+				conn.respond(cmd, "1", tt.code)
+			})
+			c, _ := newTestClient(t, s)
+
+			err := c.DialRecord(context.Background())
+			if !errors.Is(err, tt.want) || !errors.Is(err, APCError{Code: tt.code}) {
+				t.Errorf("DialRecord() error = %v, want %v wrapping %s", err, tt.want, tt.code)
+			}
+		})
+	}
+}
+
+func TestClient_SetNotifyKeyField(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if cmd.Segments[1] != "DEBT_ID" {
+			conn.respond(cmd, "1", "E28894")
+			return
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	if err := c.SetNotifyKeyField(context.Background(), ListTypeOutbound, "DEBT_ID"); err != nil {
+		t.Fatalf("SetNotifyKeyField() error = %v", err)
+	}
+
+	cmd := s.received()[0]
+	if want := []string{"O", "DEBT_ID"}; cmd.Keyword != "AGTSetNotifyKeyField" || !reflect.DeepEqual(cmd.Segments, want) {
+		t.Errorf("server received %s %q, want AGTSetNotifyKeyField %q", cmd.Keyword, cmd.Segments, want)
+	}
+
+	if err := c.SetNotifyKeyField(context.Background(), ListTypeOutbound, "BOGUS"); !errors.Is(err, APCError{Code: "E28894"}) {
+		t.Errorf("SetNotifyKeyField() error = %v, want E28894", err)
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		time.Sleep(10 * time.Millisecond)
+		conn.data(cmd, "0", "M00001", "S70004")
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	rtt, err := c.Ping(context.Background())
+	if err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	if rtt < 10*time.Millisecond {
+		t.Errorf("Ping() = %v, want at least 10ms", rtt)
+	}
+
+	if got := s.keywords(); !reflect.DeepEqual(got, []string{"AGTListState"}) {
+		t.Errorf("server received %v, want [AGTListState]", got)
+	}
+}
+
+func TestClient_Ping_Error(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.respond(cmd, "1", "E28800")
+	})
+	c, _ := newTestClient(t, s)
+
+	if rtt, err := c.Ping(context.Background()); !errors.Is(err, APCError{Code: "E28800"}) || rtt != 0 {
+		t.Errorf("Ping() = %v, %v, want 0, E28800", rtt, err)
+	}
+}
+
+func TestClient_EchoMode(t *testing.T) {
+	var reject bool
+	var mu sync.Mutex
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if reject {
+			conn.respond(cmd, "1", "E28800")
+			return
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	if !c.EchoMode() {
+		t.Error("EchoMode() = false, want true by default")
+	}
+
+	if err := c.EchoOff(context.Background()); err != nil {
+		t.Fatalf("EchoOff() error = %v", err)
+	}
+	if c.EchoMode() {
+		t.Error("EchoMode() = true after EchoOff(), want false")
+	}
+
+	mu.Lock()
+	reject = true
+	mu.Unlock()
+	if err := c.EchoOn(context.Background()); err == nil {
+		t.Fatal("EchoOn() error = nil, want E28800")
+	}
+	if c.EchoMode() {
+		t.Error("EchoMode() = true after rejected EchoOn(), want false")
+	}
+
+	mu.Lock()
+	reject = false
+	mu.Unlock()
+	if err := c.EchoOn(context.Background()); err != nil {
+		t.Fatalf("EchoOn() error = %v", err)
+	}
+	if !c.EchoMode() {
+		t.Error("EchoMode() = false after EchoOn(), want true")
+	}
+
+	want := []string{"AGTEchoOff", "AGTEchoOn", "AGTEchoOn"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_ReserveHeadset_Twice(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	for i := 0; i < 2; i++ {
+		if err := c.ReserveHeadset(context.Background(), 1); err != nil {
+			t.Fatalf("ReserveHeadset() error = %v", err)
+		}
+	}
+	if err := c.ReserveHeadset(context.Background(), 2); !errors.Is(err, ErrHeadsetAlreadyReserved) {
+		t.Errorf("ReserveHeadset() error = %v, want %v", err, ErrHeadsetAlreadyReserved)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.ConnectHeadset(context.Background()); err != nil {
+			t.Fatalf("ConnectHeadset() error = %v", err)
+		}
+	}
+
+	want := []string{"AGTReserveHeadset", "AGTConnHeadset"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_FreeHeadset_NotReserved(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		// Nothing has been reserved
+		conn.respond(cmd, "1", "E28873")
+	})
+	c, _ := newTestClient(t, s)
+
+	if err := c.DisconnectHeadset(context.Background()); err != nil {
+		t.Errorf("DisconnectHeadset() error = %v, want nil", err)
+	}
+	if err := c.FreeHeadset(context.Background()); err != nil {
+		t.Errorf("FreeHeadset() error = %v, want nil", err)
+	}
+}
+
+func TestClient_FreeHeadset_ReserveAgain(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	for _, step := range []func() error{
+		func() error { return c.ReserveHeadset(context.Background(), 1) },
+		func() error { return c.FreeHeadset(context.Background()) },
+		func() error { return c.ReserveHeadset(context.Background(), 2) },
+	} {
+		if err := step(); err != nil {
+			t.Fatalf("error = %v", err)
+		}
+	}
+
+	want := []string{"AGTReserveHeadset", "AGTFreeHeadset", "AGTReserveHeadset"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_HeadsetStatus(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		respondOK(conn, cmd)
+		if cmd.Keyword == "AGTReadyNextItem" {
+			conn.send("AGTHeadsetConnBroken", EventTypeNotification, 0, "0", "M00000")
+		}
+	})
+	c, _ := newTestClient(t, s)
+	notifications := c.Notifications(context.Background())
+
+	steps := []struct {
+		fn   func(context.Context) error
+		want HeadsetState
+	}{
+		{func(ctx context.Context) error { return c.ReserveHeadset(ctx, 1) }, HeadsetReserved},
+		{c.ConnectHeadset, HeadsetConnected},
+		{c.DisconnectHeadset, HeadsetReserved},
+		{c.ConnectHeadset, HeadsetConnected},
+		// The headset connection is broken while the agent is working
+		{func(ctx context.Context) error {
+			if err := c.ReadyNextItem(ctx); err != nil {
+				return err
+			}
+			select {
+			case <-notifications:
+				return nil
+			case <-time.After(time.Second):
+				return errors.New("AGTHeadsetConnBroken hasn't been delivered")
+			}
+		}, HeadsetReserved},
+		{c.FreeHeadset, HeadsetFree},
+	}
+
+	if got := c.HeadsetStatus(); got != HeadsetFree {
+		t.Fatalf("HeadsetStatus() = %v, want %v", got, HeadsetFree)
+	}
+	for i, step := range steps {
+		if err := step.fn(context.Background()); err != nil {
+			t.Fatalf("step %d error = %v", i, err)
+		}
+		if got := c.HeadsetStatus(); got != step.want {
+			t.Errorf("HeadsetStatus() = %v after step %d, want %v", got, i, step.want)
+		}
+	}
+}
+
+func TestClient_FreeHeadset_ConnectFailed(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		// The headset connect request did not register
+		if cmd.Keyword == "AGTConnHeadset" {
+			conn.respond(cmd, "1", "E28875")
+			return
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	if err := c.ReserveHeadset(context.Background(), 1); err != nil {
+		t.Fatalf("ReserveHeadset() error = %v", err)
+	}
+	if err := c.ConnectHeadset(context.Background()); !errors.Is(err, APCError{Code: "E28875"}) {
+		t.Fatalf("ConnectHeadset() error = %v, want E28875", err)
+	}
+
+	// The reservation is cancelled without disconnecting
+	if err := c.FreeHeadset(context.Background()); err != nil {
+		t.Fatalf("FreeHeadset() error = %v", err)
+	}
+	if err := c.ReserveHeadset(context.Background(), 2); err != nil {
+		t.Errorf("ReserveHeadset() error = %v after the reservation is cancelled", err)
+	}
+
+	want := []string{"AGTReserveHeadset", "AGTConnHeadset", "AGTFreeHeadset", "AGTReserveHeadset"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_ListFieldLabels(t *testing.T) {
+	// Screen definition from the Agent API guide
+	screen := []string{
+		"list1",
+		`F, 9,16, 0,"NAME1:1:0:C::0:1"`,
+		`F, 9,17,30,"NAME2:1:0:C::0:1"`,
+		`F,52,16,18,"ACCTNUM:1:0:C::0:1"`,
+		`F,47,17, 0,"BALANCE:0:1:C::0:1"`,
+		`F,47,18, 0,"DELQUENT:0:1:C::0:1"`,
+		`F,70,18, 0,"DAYS:0:1:C::0:1"`,
+		`F, 9,18,12,"PHONE1:1:0:C::0:1"`,
+		`F,70,20, 0,"EXTERNAL:0:1:C:A,a:0:1"`,
+		`F,54,22, 0,"BEHSCORE:0:1:C::0:1"`,
+		`L, 1,16, 6,"Name1:"`,
+		`L,36,16, 7,"Account"`,
+		`L,44,16, 7,"Number:"`,
+		`L, 1,17, 6,"Name2:"`,
+		`L,36,17, 8,"Balance:"`,
+		`L, 1,18, 5,"Home:"`,
+		`L,36,18, 3,"Del"`,
+		`L,40,18, 4,"Amt:"`,
+		`L,59,18, 4,"Days"`,
+		`L,64,18, 4,"Del:"`,
+		`L,59,20, 9,"External:"`,
+		`L,36,22, 8,"Behavior"`,
+		`L,45,22, 6,"Score:"`,
+	}
+
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		switch cmd.Keyword {
+		case "AGTListScreens":
+			conn.data(cmd, "0", "M00001", "list1")
+		case "AGTGetScreen":
+			conn.data(cmd, append([]string{"0", "M00001"}, screen...)...)
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	got, err := c.ListFieldLabels(context.Background(), ListTypeOutbound)
+	if err != nil {
+		t.Fatalf("ListFieldLabels() error = %v", err)
+	}
+
+	want := map[string]string{
+		"NAME1":    "Name1",
+		"NAME2":    "Name2",
+		"ACCTNUM":  "Account Number",
+		"BALANCE":  "Balance",
+		"PHONE1":   "Home",
+		"DELQUENT": "Del Amt",
+		"DAYS":     "Days Del",
+		"EXTERNAL": "External",
+		"BEHSCORE": "Behavior Score",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListFieldLabels() = %v, want %v", got, want)
+	}
+
+	commands := s.received()
+	if commands[0].Segments[0] != "O" || commands[1].Segments[0] != "list1" {
+		t.Errorf("server received %v, want AGTListScreens O and AGTGetScreen list1", commands)
+	}
+}
+
+func TestClient_WriteTimeout(t *testing.T) {
+	stall := make(chan struct{})
+	t.Cleanup(func() { close(stall) })
+
+	// The server stops reading after the first command
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		<-stall
+	})
+	c, done := newTestClient(t, s, WithWriteTimeout(200*time.Millisecond))
+
+	go c.Logon(context.Background(), "agent", "password")
+	for len(s.received()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The command is large enough to overflow socket buffers of a peer that doesn't read
+	huge := strings.Repeat("x", 64<<20)
+	err := c.Logon(context.Background(), "agent", huge)
+	if !errors.Is(err, ErrWriteTimeout) {
+		t.Fatalf("Logon() error = %v, want %v", err, ErrWriteTimeout)
+	}
+
+	if err := waitStart(t, done); !errors.Is(err, ErrWriteTimeout) {
+		t.Errorf("Start() error = %v, want %v", err, ErrWriteTimeout)
+	}
+}
+
+func TestClient_HeadsetTransitions(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+	ctx := context.Background()
+
+	steps := []struct {
+		name string
+		fn   func() error
+		want error
+	}{
+		{"connect free", func() error { return c.ConnectHeadset(ctx) }, ErrHeadsetNotReserved},
+		{"reserve", func() error { return c.ReserveHeadset(ctx, 1) }, nil},
+		{"connect", func() error { return c.ConnectHeadset(ctx) }, nil},
+		{"free connected", func() error { return c.FreeHeadset(ctx) }, ErrHeadsetConnected},
+		{"release line", func() error { return c.ReleaseLine(ctx) }, nil},
+		{"free still connected", func() error { return c.FreeHeadset(ctx) }, ErrHeadsetConnected},
+		{"disconnect", func() error { return c.DisconnectHeadset(ctx) }, nil},
+		{"free", func() error { return c.FreeHeadset(ctx) }, nil},
+		{"connect freed", func() error { return c.ConnectHeadset(ctx) }, ErrHeadsetNotReserved},
+	}
+	for _, step := range steps {
+		if err := step.fn(); !errors.Is(err, step.want) {
+			t.Errorf("%s: error = %v, want %v", step.name, err, step.want)
+		}
+	}
+
+	want := []string{"AGTReserveHeadset", "AGTConnHeadset", "AGTReleaseLine", "AGTDisconnHeadset", "AGTFreeHeadset"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_FreeHeadset_Rejected(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		// The headset has been connected by someone else, e.g. another agent application instance
+		conn.respond(cmd, "1", "E28879")
+	})
+	c, _ := newTestClient(t, s)
+
+	if err := c.FreeHeadset(context.Background()); !errors.Is(err, ErrHeadsetConnected) || !errors.Is(err, APCError{Code: "E28879"}) {
+		t.Errorf("FreeHeadset() error = %v, want %v wrapping E28879", err, ErrHeadsetConnected)
+	}
+}
+
+func TestClient_DisconnectHeadset_Busy(t *testing.T) {
+	var busy bool
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		// The disconnect forced by the end of the call is still pending
+		if cmd.Keyword == "AGTDisconnHeadset" && !busy {
+			busy = true
+			conn.respond(cmd, "1", "E28877")
+			return
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	if err := c.DisconnectHeadset(context.Background()); err != nil {
+		t.Fatalf("DisconnectHeadset() error = %v", err)
+	}
+	if got, want := s.keywords(), []string{"AGTDisconnHeadset", "AGTDisconnHeadset"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_DisconnectHeadset_BusyContextDone(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.respond(cmd, "1", "E28877")
+	})
+	c, _ := newTestClient(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := c.DisconnectHeadset(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DisconnectHeadset() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := s.keywords(); len(got) != 1 {
+		t.Errorf("server received %v, want a single AGTDisconnHeadset", got)
+	}
+}
+
+func TestClient_DumpData(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	if err := c.DumpData(context.Background(), "debug1"); err != nil {
+		t.Fatalf("DumpData() error = %v", err)
+	}
+
+	commands := s.received()
+	if len(commands) != 1 || commands[0].Keyword != "AGTDumpData" || !reflect.DeepEqual(commands[0].Segments, []string{"debug1"}) {
+		t.Errorf("server received %v, want AGTDumpData with debug1", commands)
+	}
+}
+
+func TestClient_MaxConcurrentCommands(t *testing.T) {
+	release := make(chan struct{})
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if cmd.Keyword == "AGTAttachJob" {
+			<-release
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s, WithMaxConcurrentCommands(1))
+
+	first := make(chan error, 1)
+	go func() {
+		first <- c.AttachJob(context.Background(), "TEST_JOB")
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for len(s.keywords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("server hasn't received the first command")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	second := make(chan error, 1)
+	go func() {
+		second <- c.DetachJob(context.Background())
+	}()
+
+	// A queued command gives up as soon as its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.AvailWork(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AvailWork() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("AvailWork() has returned after %v, want promptly", elapsed)
+	}
+
+	if got := s.keywords(); !reflect.DeepEqual(got, []string{"AGTAttachJob"}) {
+		t.Errorf("server received %v while the first command is in flight, want [AGTAttachJob]", got)
+	}
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Errorf("AttachJob() error = %v", err)
+	}
+	if err := <-second; err != nil {
+		t.Errorf("DetachJob() error = %v", err)
+	}
+
+	if got := s.keywords(); !reflect.DeepEqual(got, []string{"AGTAttachJob", "AGTDetachJob"}) {
+		t.Errorf("server received %v, want [AGTAttachJob AGTDetachJob]", got)
+	}
+}
+
+func TestClient_LastResponse(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.data(cmd, "0", "M00001", "PHONE2,N,10,0000000000")
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	if got := c.LastResponse(); len(got) != 0 {
+		t.Errorf("LastResponse() = %v before any command, want nothing", got)
+	}
+
+	if _, err := c.ReadField(context.Background(), ListTypeOutbound, "PHONE2"); err != nil {
+		t.Fatalf("ReadField() error = %v", err)
+	}
+
+	events := c.LastResponse()
+	if len(events) != 2 {
+		t.Fatalf("LastResponse() = %v, want data and response events", events)
+	}
+	if events[0].Type != EventTypeData || !reflect.DeepEqual(events[0].Segments, []string{"0", "M00001", "PHONE2,N,10,0000000000"}) {
+		t.Errorf("LastResponse()[0] = %+v, want the data event", events[0])
+	}
+	if events[1].Type != EventTypeResponse || events[1].Keyword != "AGTReadField" {
+		t.Errorf("LastResponse()[1] = %+v, want the AGTReadField response", events[1])
+	}
+}
+
+func TestClient_Logon_Credentials(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		agentName string
+		password  string
+	}{
+		{"empty name", "", "password"},
+		{"blank name", " \n", "password"},
+		{"empty password", "agent", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newMockServer(t, respondOK)
+			c, _ := newTestClient(t, s)
+
+			if err := c.Logon(context.Background(), tc.agentName, tc.password); !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("Logon() error = %v, want %v", err, ErrInvalidCredentials)
+			}
+			if got := s.keywords(); len(got) != 0 {
+				t.Errorf("server received %v, want nothing", got)
+			}
+		})
+	}
+
+	t.Run("trailing whitespace", func(t *testing.T) {
+		s := newMockServer(t, respondOK)
+		c, _ := newTestClient(t, s)
+
+		if err := c.Logon(context.Background(), "agent \n", "password\t"); err != nil {
+			t.Fatalf("Logon() error = %v", err)
+		}
+
+		commands := s.received()
+		if len(commands) != 1 || !reflect.DeepEqual(commands[0].Segments[:2], []string{"agent", "password"}) {
+			t.Errorf("server received %v, want AGTLogon with trimmed credentials", commands)
+		}
+	})
+}
+
+func TestClient_ListCallFields(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.data(cmd, "0", "M00001", "SYSNUM,4,N,F", "ACCTNUM,16,N,F", "NAME,26,C,F", "PHONE1,10,N,F", "BAL,10,$,F", "PAYDAY,8,D,F", "RECALLTIME,8,T,F", "CURPHONE,2,N,F")
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	fields, err := c.ListCallFields(context.Background(), "list1")
+	if err != nil {
+		t.Fatalf("ListCallFields() error = %v", err)
+	}
+
+	want := []string{"SYSNUM", "ACCTNUM", "NAME", "PHONE1", "BAL", "PAYDAY", "RECALLTIME", "CURPHONE"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("ListCallFields() = %v, want %v", fields, want)
+	}
+
+	if commands := s.received(); len(commands) != 1 || !reflect.DeepEqual(commands[0].Segments, []string{"list1"}) {
+		t.Errorf("server received %v, want AGTListCallFields of list1", commands)
+	}
+}
+
+func TestClient_ListDataFields(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.data(cmd, "0", "M00001", "SYSNUM,4,N,F", "NAME,26,C,F", "BAL,10,$,F", "PAYDAY,8,D,F", "RECALLTIME,8,T,F")
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	fields, err := c.ListDataFields(context.Background(), ListTypeOutbound)
+	if err != nil {
+		t.Fatalf("ListDataFields() error = %v", err)
+	}
+
+	want := []DataField{
+		{Name: "SYSNUM", Type: FieldTypeNumeric, Length: 4},
+		{Name: "NAME", Type: FieldTypeCharacter, Length: 26},
+		{Name: "BAL", Type: FieldTypeCurrency, Length: 10},
+		{Name: "PAYDAY", Type: FieldTypeDate, Length: 8},
+		{Name: "RECALLTIME", Type: FieldTypeTime, Length: 8},
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("ListDataFields() = %+v, want %+v", fields, want)
+	}
+
+	if commands := s.received(); len(commands) != 1 || !reflect.DeepEqual(commands[0].Segments, []string{"O"}) {
+		t.Errorf("server received %v, want AGTListDataFields of list type O", commands)
+	}
+}
+
+func TestClient_DescribeFields(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		switch cmd.Keyword {
+		case "AGTListDataFields":
+			conn.data(cmd, "0", "M00001", "NAME1,26,C,F", "BALANCE,10,$,F", "SYSNUM,4,N,F")
+		case "AGTListScreens":
+			conn.data(cmd, "0", "M00001", "list1")
+		case "AGTGetScreen":
+			// SYSNUM isn't shown on the screen, so it has no label
+			conn.data(cmd, "0", "M00001", "list1",
+				`F, 9,16, 0,"NAME1:1:0:C::0:1"`,
+				`F,47,17, 0,"BALANCE:0:1:C::0:1"`,
+				`L, 1,16, 6,"Name1:"`,
+				`L,36,17, 8,"Balance:"`,
+			)
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	got, err := c.DescribeFields(context.Background(), ListTypeOutbound)
+	if err != nil {
+		t.Fatalf("DescribeFields() error = %v", err)
+	}
+
+	want := []FieldDescriptor{
+		{DataField: DataField{Name: "NAME1", Type: FieldTypeCharacter, Length: 26}, Label: "Name1"},
+		{DataField: DataField{Name: "BALANCE", Type: FieldTypeCurrency, Length: 10}, Label: "Balance"},
+		{DataField: DataField{Name: "SYSNUM", Type: FieldTypeNumeric, Length: 4}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DescribeFields() = %+v, want %+v", got, want)
+	}
+}
+
+func TestClient_ListDataFields_InvalidLength(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.data(cmd, "0", "M00001", "NAME,long,C,F")
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	if _, err := c.ListDataFields(context.Background(), ListTypeOutbound); err == nil {
+		t.Error("ListDataFields() error = nil, want invalid length")
+	}
+}
+
+func TestClient_ReadFieldRaw(t *testing.T) {
+	// 0x98 is undefined in Windows-1251, the decoder replaces it
+	blob := string([]byte{0x98, 0xC0, ',', 0x00, 0xFF})
+	name, _ := charmap.Windows1251.NewEncoder().String("Иван")
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		switch cmd.Segments[1] {
+		case "BLOB":
+			conn.data(cmd, "0", "M00001", "BLOB,C,5,"+blob)
+		default:
+			conn.data(cmd, "0", "M00001", "NAME,A,20,"+name)
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s, WithDecoder(charmap.Windows1251.NewDecoder()))
+
+	raw, err := c.ReadFieldRaw(context.Background(), ListTypeOutbound, "BLOB")
+	if err != nil {
+		t.Fatalf("ReadFieldRaw() error = %v", err)
+	}
+	if !bytes.Equal(raw, []byte(blob)) {
+		t.Errorf("ReadFieldRaw() = %x, want %x", raw, blob)
+	}
+
+	// Other fields are still decoded
+	field, err := c.ReadField(context.Background(), ListTypeOutbound, "NAME")
+	if err != nil {
+		t.Fatalf("ReadField() error = %v", err)
+	}
+	if field.Value != "Иван" {
+		t.Errorf("ReadField() value = %q, want %q", field.Value, "Иван")
+	}
+	if raw, _ := c.ReadFieldRaw(context.Background(), ListTypeOutbound, "NAME"); !bytes.Equal(raw, []byte(name)) {
+		t.Errorf("ReadFieldRaw() = %x, want %x", raw, name)
+	}
+}
+
+func TestClient_UpdateField(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s, WithEncoder(charmap.Windows1251.NewEncoder()))
+
+	if err := c.UpdateField(context.Background(), ListTypeOutbound, "NOTE", "Перезвонить"); err != nil {
+		t.Fatalf("UpdateField() error = %v", err)
+	}
+
+	want, _ := charmap.Windows1251.NewEncoder().String("Перезвонить")
+	commands := s.received()
+	if len(commands) != 1 || commands[0].Keyword != "AGTUpdateField" || !reflect.DeepEqual(commands[0].Segments, []string{"O", "NOTE", want}) {
+		t.Errorf("server received %v, want AGTUpdateField w/ Windows-1251 encoded value %q", commands, want)
+	}
+}
+
+func TestClient_UpdateField_Unknown(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		conn.respond(cmd, "1", "E28894")
+	})
+	c, _ := newTestClient(t, s)
+
+	err := c.UpdateField(context.Background(), ListTypeOutbound, "BOGUS", "1")
+	if !errors.Is(err, ErrFieldNotFound) || !errors.Is(err, APCError{Code: "E28894"}) {
+		t.Errorf("UpdateField() error = %v, want %v wrapping E28894", err, ErrFieldNotFound)
+	}
+}
+
+func TestClient_ConcurrentMixedCommands(t *testing.T) {
+	s := newMockServer(t, respondField)
+	c, _ := newTestClient(t, s)
+
+	const (
+		workers    = 16
+		iterations = 20
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*iterations*3)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < iterations; j++ {
+				if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+					errs <- fmt.Errorf("Logon() error = %w", err)
+				}
+
+				name := fmt.Sprintf("FIELD%d_%d", i, j)
+				field, err := c.ReadField(context.Background(), ListTypeOutbound, name)
+				if err != nil {
+					errs <- fmt.Errorf("ReadField() error = %w", err)
+				} else if field.Value != "value of "+name {
+					// A response must never be routed to another command
+					errs <- fmt.Errorf("ReadField(%s) = %q", name, field.Value)
+				}
+
+				if err := c.FinishedItem(context.Background(), 20); err != nil {
+					errs <- fmt.Errorf("FinishedItem() error = %w", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if got := len(s.received()); got != workers*iterations*3 {
+		t.Errorf("server received %d commands, want %d", got, workers*iterations*3)
+	}
+}
+
+func TestClient_SendMessage(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	if err := c.SendMessage(context.Background(), "HELP ME"); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	// The limit is in characters, not in bytes
+	if err := c.SendMessage(context.Background(), strings.Repeat("ю", MaxMessageLength)); err != nil {
+		t.Errorf("SendMessage() error = %v for the message of maximum length", err)
+	}
+
+	if err := c.SendMessage(context.Background(), strings.Repeat("a", MaxMessageLength+1)); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("SendMessage() error = %v, want %v", err, ErrMessageTooLong)
+	}
+
+	commands := s.received()
+	if len(commands) != 2 || commands[0].Keyword != "AGTSendMessage" || !reflect.DeepEqual(commands[0].Segments, []string{"HELP ME"}) {
+		t.Errorf("server received %v, want two AGTSendMessage commands", commands)
+	}
+}
+
+// countingConn counts writes to the underlying connection
+type countingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	c.writes.Inc()
+	return c.Conn.Write(b)
+}
+
+// countingDialer returns the dialer of connections that count their writes
+func countingDialer(writes *atomic.Int64) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return countingConn{Conn: conn, writes: writes}, nil
+	}
+}
+
+func TestClient_WriteBuffer(t *testing.T) {
+	s := newMockServer(t, respondField)
+	writes := atomic.NewInt64(0)
+	c, _ := newTestClient(t, s, WithWriteBuffer(4096), WithDialer(countingDialer(writes)))
+
+	// Sequential commands are flushed one by one
+	if _, err := c.ReadField(context.Background(), ListTypeOutbound, "NAME"); err != nil {
+		t.Fatalf("ReadField() error = %v", err)
+	}
+
+	names := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("FIELD%d", i))
+	}
+	for i := 0; i < 10; i++ {
+		values, err := c.ReadFields(context.Background(), ListTypeOutbound, names...)
+		if err != nil {
+			t.Fatalf("ReadFields() error = %v", err)
+		}
+		for _, name := range names {
+			if want := "value of " + name; values[name] != want {
+				t.Errorf("ReadFields()[%s] = %q, want %q", name, values[name], want)
+			}
+		}
+	}
+
+	if n := countKeyword(s, "AGTReadField"); n != 201 {
+		t.Errorf("server received %d AGTReadField, want 201", n)
+	}
+	t.Logf("%d commands written with %d writes", 201, writes.Load())
+}
+
+// deadlineConn fails to set the write deadline while fail is set
+type deadlineConn struct {
+	net.Conn
+	fail *atomic.Bool
+}
+
+func (c deadlineConn) SetWriteDeadline(t time.Time) error {
+	if c.fail.Load() {
+		return errors.New("cannot set write deadline")
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func TestClient_WriteBuffer_DeadlineError(t *testing.T) {
+	s := newMockServer(t, respondField)
+	fail := atomic.NewBool(false)
+	c, _ := newTestClient(t, s, WithWriteBuffer(4096), WithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return deadlineConn{Conn: conn, fail: fail}, nil
+	}))
+
+	// Another writer is queued, so the command is left in the buffer for it to flush
+	c.queuedWrites.Inc()
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		_, err := c.ReadField(ctx, ListTypeOutbound, "NAME")
+		result <- err
+	}()
+
+	for buffered := 0; buffered == 0; {
+		time.Sleep(time.Millisecond)
+		c.writeMu.Lock()
+		buffered = c.writeBuf.Buffered()
+		c.writeMu.Unlock()
+	}
+	c.queuedWrites.Dec()
+
+	// The queued writer can't set its deadline, but it still flushes the buffered command
+	fail.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.write(ctx, []byte("AGTEchoOn")); err == nil {
+		t.Fatal("write() error = nil, want the deadline error")
+	}
+	fail.Store(false)
+
+	if err := <-result; err != nil {
+		t.Errorf("ReadField() error = %v", err)
+	}
+}
+
+func BenchmarkClient_WriteBuffer(b *testing.B) {
+	names := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("FIELD%d", i))
+	}
+
+	for _, size := range []int{0, 4096} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			s := newMockServer(b, respondField)
+
+			writes := atomic.NewInt64(0)
+			c, err := NewClient(s.addr(), WithTlsSkipVerify(), WithWriteBuffer(size), WithDialer(countingDialer(writes)))
+			if err != nil {
+				b.Fatalf("NewClient() error = %v", err)
+			}
+			go c.Start()
+			defer c.Stop()
+
+			// The banner exchange isn't counted
+			writes.Store(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.ReadFields(context.Background(), ListTypeOutbound, names...); err != nil {
+					b.Fatalf("ReadFields() error = %v", err)
+				}
+			}
+			b.ReportMetric(float64(writes.Load())/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// respondRecord is the mockHandler of an agent working on a record: AGTNoFurtherWork is held
+// until AGTFinishedItem releases the record.
+func respondRecord() mockHandler {
+	var (
+		onRecord = true
+		held     *Event
+	)
+
+	return func(conn *mockConn, cmd Event) {
+		switch {
+		case cmd.Keyword == "AGTNoFurtherWork" && onRecord:
+			conn.send(cmd.Keyword, EventTypePending, cmd.InvokeID, "0", "S28833")
+			held = &cmd
+		case cmd.Keyword == "AGTFinishedItem" && !onRecord:
+			conn.respond(cmd, "1", "E28919")
+		case cmd.Keyword == "AGTFinishedItem":
+			onRecord = false
+			respondOK(conn, cmd)
+			if held != nil {
+				respondOK(conn, *held)
+				held = nil
+			}
+		default:
+			respondOK(conn, cmd)
+		}
+	}
+}
+
+func TestClient_NoFurtherWork_AfterCurrent(t *testing.T) {
+	s := newMockServer(t, respondRecord())
+	c, _ := newTestClient(t, s)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.NoFurtherWork(context.Background())
+	}()
+
+	// The logout is held while the agent is on the record
+	select {
+	case err := <-done:
+		t.Fatalf("NoFurtherWork() = %v before the record is finished", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := c.FinishedItem(context.Background(), 20); err != nil {
+		t.Fatalf("FinishedItem() error = %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("NoFurtherWork() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("NoFurtherWork() has not returned after the record is finished")
+	}
+}
+
+func TestClient_NoFurtherWork_Immediate(t *testing.T) {
+	s := newMockServer(t, respondRecord())
+	c, _ := newTestClient(t, s)
+
+	opts := NoFurtherWorkOptions{Immediate: true, CompCode: 20}
+	if err := c.NoFurtherWorkOpts(context.Background(), opts); err != nil {
+		t.Fatalf("NoFurtherWorkOpts() error = %v", err)
+	}
+
+	received := s.received()
+	if got, want := s.keywords(), []string{"AGTNoFurtherWork", "AGTFinishedItem"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("server received %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(received[1].Segments, []string{"20"}) {
+		t.Errorf("AGTFinishedItem segments = %v, want completion code 20", received[1].Segments)
+	}
+
+	// There is no record to release anymore, that's fine
+	if err := c.NoFurtherWorkOpts(context.Background(), opts); err != nil {
+		t.Errorf("NoFurtherWorkOpts() error = %v without a record", err)
+	}
+}
+
+func TestClient_NoFurtherWork_ImmediateSingleSlot(t *testing.T) {
+	s := newMockServer(t, respondRecord())
+	c, _ := newTestClient(t, s, WithMaxConcurrentCommands(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := c.NoFurtherWorkOpts(ctx, NoFurtherWorkOptions{Immediate: true, CompCode: 20}); err != nil {
+		t.Fatalf("NoFurtherWorkOpts() error = %v", err)
+	}
+	if got, want := s.keywords(), []string{"AGTNoFurtherWork", "AGTFinishedItem"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestClient_Logoff(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, done := newTestClient(t, s)
+
+	if err := c.Logoff(context.Background()); err != nil {
+		t.Fatalf("Logoff() error = %v", err)
+	}
+	if got, want := s.keywords(), []string{"AGTLogoff"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+
+	// The server terminates the session after the logoff
+	if err := waitStart(t, done); err != nil {
+		t.Errorf("Start() error = %v after Logoff()", err)
+	}
+}
+
+// respondActiveCall is the mockHandler of an agent on a call within a job: AGTLogoff is rejected
+// until the job is detached.
+func respondActiveCall() mockHandler {
+	var (
+		attached = true
+		record   = respondRecord()
+	)
+
+	return func(conn *mockConn, cmd Event) {
+		switch cmd.Keyword {
+		case "AGTLogoff":
+			if attached {
+				conn.respond(cmd, "1", "E28916")
+				return
+			}
+			respondOK(conn, cmd)
+		case "AGTDetachJob":
+			attached = false
+			respondOK(conn, cmd)
+		default:
+			record(conn, cmd)
+		}
+	}
+}
+
+func TestClient_Logoff_ActiveCall(t *testing.T) {
+	s := newMockServer(t, respondActiveCall())
+	c, _ := newTestClient(t, s)
+
+	err := c.Logoff(context.Background())
+	if !errors.Is(err, ErrPendingWork) || !errors.Is(err, APCError{Code: "E28916"}) {
+		t.Fatalf("Logoff() error = %v, want %v", err, ErrPendingWork)
+	}
+
+	if err := c.LogoffOpts(context.Background(), LogoffOptions{Force: true, CompCode: 20}); err != nil {
+		t.Fatalf("LogoffOpts() error = %v", err)
+	}
+
+	want := []string{"AGTLogoff", "AGTLogoff", "AGTNoFurtherWork", "AGTFinishedItem", "AGTDetachJob", "AGTLogoff"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+	if received := s.received(); !reflect.DeepEqual(received[3].Segments, []string{"20"}) {
+		t.Errorf("AGTFinishedItem segments = %v, want completion code 20", received[3].Segments)
+	}
+}
+
+func TestClient_ReadPhoneField(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		switch cmd.Segments[1] {
+		case "PHONE1":
+			conn.data(cmd, "0", "M00001", "PHONE1,N,10,2032699002")
+		case "ZONEPHONE1":
+			conn.data(cmd, "0", "M00001", "ZONEPHONE1,C,1,E")
+		case "PHONECNT1":
+			conn.data(cmd, "0", "M00001", "PHONECNT1,N,2, 3")
+		case "PHONE2":
+			conn.data(cmd, "0", "M00001", "PHONE2,N,10,4255521009")
+		default:
+			// The list has no other phone fields
+			conn.respond(cmd, "1", "E28894")
+			return
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	phone, err := c.ReadPhoneField(context.Background(), ListTypeOutbound, 1)
+	if err != nil {
+		t.Fatalf("ReadPhoneField() error = %v", err)
+	}
+	if want := (PhoneInfo{Index: 1, Number: "2032699002", Zone: "E", Attempts: 3}); phone != want {
+		t.Errorf("ReadPhoneField() = %+v, want %+v", phone, want)
+	}
+
+	phone, err = c.ReadPhoneField(context.Background(), ListTypeOutbound, 2)
+	if err != nil {
+		t.Fatalf("ReadPhoneField() error = %v", err)
+	}
+	if want := (PhoneInfo{Index: 2, Number: "4255521009"}); phone != want {
+		t.Errorf("ReadPhoneField() = %+v, want %+v", phone, want)
+	}
+
+	if _, err := c.ReadPhoneField(context.Background(), ListTypeOutbound, 3); !errors.Is(err, APCError{Code: "E28894"}) {
+		t.Errorf("ReadPhoneField() error = %v, want E28894", err)
+	}
+	if _, err := c.ReadPhoneField(context.Background(), ListTypeOutbound, 0); err == nil {
+		t.Error("ReadPhoneField() error = nil, want invalid phone index")
+	}
+}
+
+func TestClient_SetDataFields(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithMaxConcurrentCommands(2)}} {
+		s := newMockServer(t, func(conn *mockConn, cmd Event) {
+			if cmd.Segments[1] == "BOGUS" {
+				conn.respond(cmd, "1", "E28894")
+				return
+			}
+			respondOK(conn, cmd)
+		})
+		c, _ := newTestClient(t, s, opts...)
+
+		names := []string{"DEBT_ID", "CURPHONE", "BOGUS", "NAME1", "BALANCE"}
+		err := c.SetDataFields(context.Background(), ListTypeOutbound, names...)
+
+		var fieldsErr SetDataFieldsError
+		if !errors.As(err, &fieldsErr) {
+			t.Fatalf("SetDataFields() error = %v, want SetDataFieldsError", err)
+		}
+		if !strings.HasPrefix(err.Error(), "cannot set data fields: ") {
+			t.Errorf("SetDataFields() error = %q, want it to tell fields are set", err)
+		}
+		if len(fieldsErr) != 1 || !errors.Is(fieldsErr["BOGUS"], APCError{Code: "E28894"}) {
+			t.Errorf("SetDataFields() error = %v, want BOGUS rejected only", err)
+		}
+
+		// Fields are sent in order, it's the order of fields in call notifications
+		var got []string
+		for _, cmd := range s.received() {
+			got = append(got, cmd.Segments[1])
+		}
+		if !reflect.DeepEqual(got, names) {
+			t.Errorf("server received fields %v, want %v", got, names)
+		}
+	}
+}
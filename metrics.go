@@ -0,0 +1,25 @@
+package apc
+
+import "time"
+
+// Collector receives metrics of Client, see WithMetrics.
+// Implementations must be safe for concurrent use and shouldn't block, because hooks are called
+// right on the command and notification paths.
+type Collector interface {
+	// CommandStarted is called before a command is sent
+	CommandStarted(keyword string)
+	// CommandFinished is called when a command is completed; err is nil in case of success
+	CommandFinished(keyword string, duration time.Duration, err error)
+	// NotificationReceived is called for every received notification
+	NotificationReceived(notificationType NotificationType)
+	// DecodeFailed is called for every received event that couldn't be decoded
+	DecodeFailed()
+}
+
+// nopCollector is used when metrics are not in use.
+type nopCollector struct{}
+
+func (nopCollector) CommandStarted(string)                        {}
+func (nopCollector) CommandFinished(string, time.Duration, error) {}
+func (nopCollector) NotificationReceived(NotificationType)        {}
+func (nopCollector) DecodeFailed()                                {}
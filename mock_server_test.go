@@ -0,0 +1,281 @@
+package apc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockHandler is called by mockServer for every decoded command
+type mockHandler func(conn *mockConn, cmd Event)
+
+// mockServer is the TLS server that imitates an APC Agent API server in tests
+type mockServer struct {
+	listener net.Listener
+	handler  mockHandler
+
+	mu       sync.Mutex
+	commands []Event
+	conns    []*mockConn
+}
+
+func newMockServer(t testing.TB, handler mockHandler) *mockServer {
+	t.Helper()
+
+	cert, _, _ := newTestCertificate(t)
+
+	return newMockServerWithConfig(t, &tls.Config{Certificates: []tls.Certificate{cert}}, handler)
+}
+
+func newMockServerWithConfig(t testing.TB, config *tls.Config, handler mockHandler) *mockServer {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+
+	s := &mockServer{
+		listener: listener,
+		handler:  handler,
+	}
+	go s.serve()
+
+	t.Cleanup(s.close)
+
+	return s
+}
+
+func (s *mockServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *mockServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		mc := &mockConn{Conn: conn}
+		s.mu.Lock()
+		s.conns = append(s.conns, mc)
+		s.mu.Unlock()
+
+		go s.handle(mc)
+	}
+}
+
+func (s *mockServer) handle(conn *mockConn) {
+	defer conn.Close()
+
+	// Greet the client the same way APC server does
+	conn.send("AGTSTART", EventTypeNotification, 0, "0", "AGENT_STARTUP")
+
+	r := bufio.NewReader(conn)
+	for {
+		raw, err := r.ReadString(ETX)
+		if err != nil {
+			return
+		}
+
+		cmd, err := DecodeEvent(raw)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+
+		if s.handler != nil {
+			s.handler(conn, cmd)
+		}
+	}
+}
+
+// received returns all commands received by the server so far
+func (s *mockServer) received() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Event(nil), s.commands...)
+}
+
+// keywords returns keywords of all commands received by the server so far
+func (s *mockServer) keywords() []string {
+	commands := s.received()
+
+	keywords := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		keywords = append(keywords, cmd.Keyword)
+	}
+
+	return keywords
+}
+
+func (s *mockServer) close() {
+	_ = s.listener.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// mockConn is the server side of a client connection
+type mockConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+// send writes a single event frame to the client
+func (c *mockConn) send(keyword string, eventType EventType, invokeID uint32, segments ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, _ = c.Write(encodeEvent(keyword, eventType, invokeID, segments...))
+}
+
+// respond writes a response event to the command
+func (c *mockConn) respond(cmd Event, segments ...string) {
+	c.send(cmd.Keyword, EventTypeResponse, cmd.InvokeID, segments...)
+}
+
+// data writes a data event to the command
+func (c *mockConn) data(cmd Event, segments ...string) {
+	c.send(cmd.Keyword, EventTypeData, cmd.InvokeID, segments...)
+}
+
+// dataBlock writes a block of an incomplete data event to the command, it's terminated by ETB
+func (c *mockConn) dataBlock(cmd Event, segments ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	frame := encodeEvent(cmd.Keyword, EventTypeData, cmd.InvokeID, segments...)
+	frame[len(frame)-1] = ETB
+	_, _ = c.Write(frame)
+}
+
+// respondOK is the mockHandler that successfully completes every command
+func respondOK(conn *mockConn, cmd Event) {
+	conn.respond(cmd, "0", "M00000")
+}
+
+// encodeEvent encodes an event the same way APC server does
+func encodeEvent(keyword string, eventType EventType, invokeID uint32, segments ...string) []byte {
+	buf := bytes.NewBuffer(nil)
+
+	buf.WriteString(fmt.Sprintf("%-20s", keyword))
+	buf.WriteByte(byte(eventType))
+	buf.WriteString(fmt.Sprintf("%-20s", "Agent server"))
+	buf.WriteString(fmt.Sprintf("%-6d", 1539))
+	buf.WriteString(fmt.Sprintf("%-4d", invokeID))
+	buf.WriteString(fmt.Sprintf("%-4d", len(segments)))
+
+	if len(segments) > 0 {
+		buf.WriteByte(RS)
+		for i, s := range segments {
+			buf.WriteString(s)
+
+			if len(segments)-1 != i {
+				buf.WriteByte(RS)
+			}
+		}
+	}
+	buf.WriteByte(ETX)
+
+	return buf.Bytes()
+}
+
+// newTestCertificate returns self-signed certificate for 127.0.0.1 and its PEM encoded form.
+func newTestCertificate(t testing.TB) (cert tls.Certificate, certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Agent server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %v", err)
+	}
+
+	cert = tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return cert, certPEM, keyPEM
+}
+
+// newTestClient connects to the mock server and starts main event loop;
+// the returned channel receives an error returned by Start().
+func newTestClient(t *testing.T, s *mockServer, opts ...Option) (*Client, <-chan error) {
+	t.Helper()
+
+	c, err := NewClient(s.addr(), append([]Option{WithTlsSkipVerify()}, opts...)...)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Start()
+	}()
+	// Stop before the main event loop starts would close the client without it
+	for !c.started.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Cleanup(c.Stop)
+
+	return c, done
+}
+
+// waitStart waits for Start() to return its error
+func waitStart(t *testing.T, done <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start() has not returned")
+		return nil
+	}
+}
@@ -0,0 +1,29 @@
+//go:build go1.23
+
+package apc
+
+import (
+	"context"
+	"iter"
+)
+
+// NotificationsSeq returns an iterator over notifications for range-over-func loops, e.g.
+//
+//	for n := range c.NotificationsSeq(ctx) {
+//		...
+//	}
+//
+// Every iteration subscribes on its own and the subscription is released when the loop ends, either by break
+// or because ctx is done or the connection is closed.
+func (c *Client) NotificationsSeq(ctx context.Context) iter.Seq[Notification] {
+	return func(yield func(Notification) bool) {
+		notifications, unsubscribe := c.Subscribe(ctx)
+		defer unsubscribe()
+
+		for n := range notifications {
+			if !yield(n) {
+				return
+			}
+		}
+	}
+}
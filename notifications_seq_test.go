@@ -0,0 +1,65 @@
+//go:build go1.23
+
+package apc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClient_NotificationsSeq(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		respondOK(conn, cmd)
+		conn.send("AGTJobEnd", EventTypeNotification, 0, "0", "M00000")
+	})
+	c, _ := newTestClient(t, s)
+
+	received := make(chan Notification, 1)
+	go func() {
+		for n := range c.NotificationsSeq(context.Background()) {
+			received <- n
+			break
+		}
+		close(received)
+	}()
+
+	// Wait for the loop to subscribe before the notification is sent
+	deadline := time.Now().Add(time.Second)
+	for subscribers(c) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("NotificationsSeq() hasn't subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); err != nil {
+		t.Fatalf("AttachJob() error = %v", err)
+	}
+
+	select {
+	case n := <-received:
+		if n.Type != NotificationTypeJobEnd {
+			t.Errorf("NotificationsSeq() yielded %v, want %v", n.Type, NotificationTypeJobEnd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("NotificationsSeq() hasn't yielded a notification")
+	}
+
+	// Breaking the loop releases the subscription
+	<-received
+	deadline = time.Now().Add(time.Second)
+	for subscribers(c) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription is still registered after the loop has ended")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func subscribers(c *Client) int {
+	c.subscribersMu.Lock()
+	defer c.subscribersMu.Unlock()
+
+	return len(c.subscribers)
+}
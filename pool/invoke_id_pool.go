@@ -82,3 +82,12 @@ func (pool *InvokeIDPool) Release(id uint32) {
 	// Add it to the set of recycled IDs.
 	pool.used[id] = true
 }
+
+// Stats returns the largest value given out that hasn't been shrunk back and the number
+// of recycled values available for reuse; maxUsed minus recycled values are checked out.
+func (pool *InvokeIDPool) Stats() (maxUsed uint32, recycled int) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	return pool.maxUsed, len(pool.used)
+}
@@ -92,6 +92,17 @@ func TestInvokeIDPool_GetFromUsedSet(t *testing.T) {
 	pool.want(&InvokeIDPool{used: map[uint32]bool{}, maxUsed: 2}, t)
 }
 
+func TestInvokeIDPool_Stats(t *testing.T) {
+	pool := NewInvokeIDPool()
+	id1 := pool.Get()
+	pool.Get()
+	pool.Release(id1)
+
+	if maxUsed, recycled := pool.Stats(); maxUsed != 2 || recycled != 1 {
+		t.Errorf("pool.Stats() = %v, %v, want 2, 1", maxUsed, recycled)
+	}
+}
+
 func wantError(want string, t *testing.T) {
 	rec := recover()
 	if rec == nil {
@@ -0,0 +1,98 @@
+// Package prometheus provides apc.Collector that exposes Client metrics to Prometheus.
+package prometheus
+
+import (
+	"time"
+
+	"github.com/L11R/go-apc"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements both apc.Collector and prometheus.Collector, so it could be passed to apc.WithMetrics
+// and registered in a prometheus.Registerer. One Collector could be shared by many clients.
+type Collector struct {
+	commands      *prom.CounterVec
+	duration      *prom.HistogramVec
+	inFlight      *prom.GaugeVec
+	notifications *prom.CounterVec
+	decodeErrors  prom.Counter
+}
+
+var _ apc.Collector = (*Collector)(nil)
+
+// NewCollector returns Collector w/ metrics in the namespace, e.g. "apc".
+func NewCollector(namespace string) *Collector {
+	return &Collector{
+		commands: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "commands_total",
+			Help:      "Total number of completed commands by keyword and status.",
+		}, []string{"keyword", "status"}),
+		duration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "command_duration_seconds",
+			Help:      "Duration of commands by keyword.",
+			Buckets:   prom.DefBuckets,
+		}, []string{"keyword"}),
+		inFlight: prom.NewGaugeVec(prom.GaugeOpts{
+			Namespace: namespace,
+			Name:      "commands_in_flight",
+			Help:      "Number of commands waiting for a response by keyword.",
+		}, []string{"keyword"}),
+		notifications: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "notifications_total",
+			Help:      "Total number of received notifications by type.",
+		}, []string{"type"}),
+		decodeErrors: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "decode_errors_total",
+			Help:      "Total number of received events that couldn't be decoded.",
+		}),
+	}
+}
+
+// CommandStarted implements apc.Collector.
+func (c *Collector) CommandStarted(keyword string) {
+	c.inFlight.WithLabelValues(keyword).Inc()
+}
+
+// CommandFinished implements apc.Collector.
+func (c *Collector) CommandFinished(keyword string, duration time.Duration, err error) {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+
+	c.inFlight.WithLabelValues(keyword).Dec()
+	c.commands.WithLabelValues(keyword, status).Inc()
+	c.duration.WithLabelValues(keyword).Observe(duration.Seconds())
+}
+
+// NotificationReceived implements apc.Collector.
+func (c *Collector) NotificationReceived(notificationType apc.NotificationType) {
+	c.notifications.WithLabelValues(string(notificationType)).Inc()
+}
+
+// DecodeFailed implements apc.Collector.
+func (c *Collector) DecodeFailed() {
+	c.decodeErrors.Inc()
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prom.Desc) {
+	c.commands.Describe(ch)
+	c.duration.Describe(ch)
+	c.inFlight.Describe(ch)
+	c.notifications.Describe(ch)
+	c.decodeErrors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prom.Metric) {
+	c.commands.Collect(ch)
+	c.duration.Collect(ch)
+	c.inFlight.Collect(ch)
+	c.notifications.Collect(ch)
+	c.decodeErrors.Collect(ch)
+}
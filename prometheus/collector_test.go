@@ -0,0 +1,41 @@
+package prometheus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/L11R/go-apc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector("apc")
+
+	c.CommandStarted("AGTLogon")
+	c.CommandFinished("AGTLogon", 10*time.Millisecond, nil)
+	c.CommandStarted("AGTAttachJob")
+	c.CommandFinished("AGTAttachJob", 10*time.Millisecond, errors.New("E28889"))
+	c.CommandStarted("AGTAvailWork")
+	c.NotificationReceived(apc.NotificationTypeCallNotify)
+	c.DecodeFailed()
+
+	if got := testutil.ToFloat64(c.commands.WithLabelValues("AGTLogon", "ok")); got != 1 {
+		t.Errorf("AGTLogon ok commands = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(c.commands.WithLabelValues("AGTAttachJob", "error")); got != 1 {
+		t.Errorf("AGTAttachJob error commands = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(c.inFlight.WithLabelValues("AGTAvailWork")); got != 1 {
+		t.Errorf("AGTAvailWork commands in flight = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(c.notifications.WithLabelValues("AGTCallNotify")); got != 1 {
+		t.Errorf("AGTCallNotify notifications = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(c.decodeErrors); got != 1 {
+		t.Errorf("decode errors = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(c, "apc_command_duration_seconds"); got != 2 {
+		t.Errorf("command duration series = %v, want 2", got)
+	}
+}
@@ -2,10 +2,14 @@ package apc
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -36,6 +40,22 @@ type Event struct {
 	InvokeID     uint32
 	Segments     []string
 	IsIncomplete bool
+	// ReceivedAt is the time the event has been read from the connection, it's zero for events decoded by DecodeEvent;
+	// an event assembled from several blocks has the time of the last one
+	ReceivedAt time.Time
+
+	// rawSegments are the segments as they are on the wire, before the decoder (see WithDecoder);
+	// they are kept only if there is a decoder, otherwise Segments are the same.
+	rawSegments [][]byte
+}
+
+// rawSegment returns the i-th segment as it's received.
+func (e Event) rawSegment(i int) []byte {
+	if e.rawSegments != nil {
+		return e.rawSegments[i]
+	}
+
+	return []byte(e.Segments[i])
 }
 
 func (e Event) IsStart() bool {
@@ -49,6 +69,45 @@ func (e Event) IsStart() bool {
 	return true
 }
 
+// ServerInfo describes the agent binary that has accepted the connection, it's taken from AGTSTART banner.
+type ServerInfo struct {
+	// Name of the server side, usually it's "Agent server"
+	Name string
+	// ProcessID of the agent binary serving the connection
+	ProcessID uint32
+	// Message of the banner, e.g. AGENT_STARTUP
+	Message string
+	// Extra segments that some server versions append to the banner
+	Extra []string
+}
+
+// SessionID identifies the session on the server side: every connection is served by own agent binary process,
+// which stamps all its events with the server name and its process ID. It's meant for correlation of logs
+// of several agents with each other and with the server logs.
+type SessionID struct {
+	Server    string
+	ProcessID uint32
+}
+
+// String returns the session ID formatted as "<server>/<process ID>", e.g. "Agent server/1539".
+func (id SessionID) String() string {
+	return fmt.Sprintf("%s/%d", id.Server, id.ProcessID)
+}
+
+// serverInfo parses AGTSTART event into ServerInfo.
+func serverInfo(event Event) (ServerInfo, error) {
+	if event.Keyword != "AGTSTART" || !event.IsStart() {
+		return ServerInfo{}, ErrHelloNotReceived
+	}
+
+	return ServerInfo{
+		Name:      event.Client,
+		ProcessID: event.ProcessID,
+		Message:   event.Segments[1],
+		Extra:     event.Segments[2:],
+	}, nil
+}
+
 func (e Event) IsPending() bool {
 	if e.Type != EventTypePending ||
 		len(e.Segments) < 2 ||
@@ -183,7 +242,10 @@ func IsDecodingError(err error) bool {
 	return ok
 }
 
-func decodeEvent(raw string) (event Event, err error) {
+// DecodeEvent decodes the single raw frame of Agent API including its terminator, e.g. a frame recorded
+// by WithWireLog. A malformed frame is reported as a decoding error (see IsDecodingError), it never panics.
+// Blocks of incomplete messages are decoded one by one, IsIncomplete tells whether more blocks follow.
+func DecodeEvent(raw string) (event Event, err error) {
 	if len(raw) < 56 {
 		return Event{}, newDecodingError("event len should be less or equal to 55 bytes")
 	}
@@ -233,24 +295,158 @@ func decodeEvent(raw string) (event Event, err error) {
 	return
 }
 
-type AvayaError struct {
+// frameReader splits the stream into raw events terminated by ETX or ETB,
+// no matter how they are fragmented or coalesced by reads.
+type frameReader struct {
+	r   io.Reader
+	buf []byte
+	// number of empty reads in a row
+	emptyReads int
+}
+
+// maxEmptyReads is the number of empty reads in a row after which the reader is considered broken, as in bufio.
+const maxEmptyReads = 100
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: r}
+}
+
+// next returns the next raw event including its terminator.
+func (f *frameReader) next() (string, error) {
+	for {
+		if i := bytes.IndexAny(f.buf, string([]byte{ETX, ETB})); i >= 0 {
+			frame := string(f.buf[:i+1])
+			f.buf = f.buf[i+1:]
+			return frame, nil
+		}
+
+		// 4096 bytes is the maximum request size, but 256 should be enough for a single read;
+		// longer events are assembled from several reads.
+		chunk := make([]byte, 256)
+		n, err := f.r.Read(chunk)
+		f.buf = append(f.buf, chunk[:n]...)
+		if err != nil {
+			return "", err
+		}
+
+		// Some TLS layers return empty reads now and then, only a reader stuck on them is an error
+		if n == 0 {
+			f.emptyReads++
+			if f.emptyReads >= maxEmptyReads {
+				return "", io.ErrNoProgress
+			}
+			continue
+		}
+		f.emptyReads = 0
+	}
+}
+
+// blockMerger merges blocks of incomplete messages: an ETB terminated event is held back
+// until the ETX terminated one with the same invoke ID arrives, then a single event is emitted.
+// Only blocks of the same type and keyword are continuations; any other event, e.g. the response of a command
+// that has completed before the continuation arrived, flushes the held block as it is, still incomplete,
+// so processRequest fails with ErrIncompleteResponse instead of waiting for the response forever.
+type blockMerger map[uint32]Event
+
+// merge returns the events to pass on: none while the message is incomplete, the merged event once it's complete,
+// or the incomplete held block followed by the event that isn't its continuation.
+func (m blockMerger) merge(event Event) []Event {
+	var flushed []Event
+	if head, ok := m[event.InvokeID]; ok {
+		if head.Type == event.Type && head.Keyword == event.Keyword {
+			head.Segments = append(head.Segments, event.Segments...)
+			if head.rawSegments != nil && event.rawSegments != nil {
+				head.rawSegments = append(head.rawSegments, event.rawSegments...)
+			} else {
+				head.rawSegments = nil
+			}
+			head.IsIncomplete = event.IsIncomplete
+			head.ReceivedAt = event.ReceivedAt
+			event = head
+		} else {
+			flushed = append(flushed, head)
+		}
+	}
+
+	if event.IsIncomplete {
+		m[event.InvokeID] = event
+		return flushed
+	}
+	delete(m, event.InvokeID)
+
+	return append(flushed, event)
+}
+
+// APCError is the error sent by APC server in response to a command.
+type APCError struct {
+	// Keyword of the failed command, e.g. AGTAttachJob
+	Keyword string
+	// Code is the message code of the error, e.g. E28885
 	Code string
+	// Message contains additional data segments of the error if any
+	Message string
 }
 
-func (e AvayaError) Error() string {
-	return e.Code
+func (e APCError) Error() string {
+	text := e.Code
+	if e.Keyword != "" {
+		text = e.Keyword + ": " + text
+	}
+	if e.Message != "" {
+		text += " (" + e.Message + ")"
+	}
+
+	return text
 }
 
-func processRequest(r *request) ([]string, error) {
-	var (
-		dataSegments []string
-		batch        bool
-	)
+// Is reports whether the target is APCError with the same code, so errors.Is could be used to match
+// specific failures, e.g. errors.Is(err, APCError{Code: "E28885"}). Keyword and Message of the target are matched
+// only if they are set.
+func (e APCError) Is(target error) bool {
+	t, ok := target.(APCError)
+	if !ok {
+		return false
+	}
+
+	return t.Code == e.Code &&
+		(t.Keyword == "" || t.Keyword == e.Keyword) &&
+		(t.Message == "" || t.Message == e.Message)
+}
+
+// AvayaError is the former name of APCError.
+//
+// Deprecated: use APCError instead.
+type AvayaError = APCError
+
+// processRequest collects data segments of the request until it completes.
+//
+// Data messages that don't fit into a single message are terminated by ETB instead of ETX and continue in the next
+// message(s); usually it's the case of list commands with a long output like AGTListJobs, AGTListKeys,
+// AGTListCallLists, AGTListCallFields and AGTListDataFields. Continuation messages carry only the rest of segments,
+// so they are merged into the data of the incomplete message. If the command completes while the continuation
+// is still awaited, ErrIncompleteResponse is returned.
+func processRequest(r *request) (dataSegments []string, err error) {
+	// Remember the outcome, it's reported when the request is finished
+	defer func() {
+		r.err = err
+	}()
+
+	var batch bool
 el:
 	for {
 		select {
 		case event := <-r.eventChan:
+			r.events = append(r.events, event)
+
 			switch {
+			// Continuation of the incomplete message goes first: its segments could look like anything
+			case batch && event.Type != EventTypeResponse:
+				dataSegments = append(dataSegments, event.Segments...)
+				// If event is complete then unmark it as a batch
+				if !event.IsIncomplete {
+					batch = false
+				}
+				continue
 			// Skip pending events
 			case event.IsPending():
 				continue
@@ -262,24 +458,24 @@ el:
 					batch = true
 				}
 				continue
+			// Response has arrived before the continuation
 			case batch:
-				dataSegments = append(dataSegments, event.Segments...)
-				// If event is complete then unmark it as a batch
-				if !event.IsIncomplete {
-					batch = false
-				}
-				continue
+				return nil, ErrIncompleteResponse
 			// Break the loop in case of success
 			case event.IsSuccessfulResponse():
 				break el
 			// Return error immediately
 			case event.IsResponseError():
-				return nil, AvayaError{Code: event.Segments[1]}
+				return nil, APCError{
+					Keyword: event.Keyword,
+					Code:    event.Segments[1],
+					Message: strings.Join(event.Segments[2:], ","),
+				}
 			default:
 				return nil, fmt.Errorf("unexpected event")
 			}
 		case <-r.context.Done():
-			return nil, r.context.Err()
+			return nil, context.Cause(r.context)
 		}
 	}
 
@@ -289,6 +485,42 @@ el:
 type Notification struct {
 	Type    NotificationType
 	Payload interface{}
+	// Changed are sorted names of fields of the call notification that differ from the previous one,
+	// including the removed ones; it's filled only with WithFieldChanges
+	Changed []string
+	// ReceivedAt is the time the last event of the notification has been read from the connection
+	ReceivedAt time.Time
+}
+
+// fieldChanges fills Changed of call notifications before they are published, see WithFieldChanges.
+// Notifications are published from a single goroutine, so it isn't guarded.
+type fieldChanges struct {
+	publish func(Notification)
+	prev    map[string]string
+}
+
+func (f *fieldChanges) track(n Notification) {
+	if n.Type == NotificationTypeCallNotify {
+		fields, _ := n.Payload.(map[string]string)
+
+		changed := make([]string, 0, len(fields))
+		for name, value := range fields {
+			if prev, ok := f.prev[name]; !ok || prev != value {
+				changed = append(changed, name)
+			}
+		}
+		for name := range f.prev {
+			if _, ok := fields[name]; !ok {
+				changed = append(changed, name)
+			}
+		}
+		sort.Strings(changed)
+
+		n.Changed = changed
+		f.prev = fields
+	}
+
+	f.publish(n)
 }
 
 type NotificationType string
@@ -301,9 +533,98 @@ const (
 	NotificationTypeJobTransRequest   NotificationType = "AGTJobTransRequest"
 	NotificationTypeHeadsetConnBroken NotificationType = "AGTHeadsetConnBroken"
 	NotificationTypeSystemError       NotificationType = "AGTSystemError"
+	// NotificationTypePreviewRecord carries the customer record to preview on Managed Dialing jobs,
+	// its payload is the map of fields requested by SetDataField, the same as AGTCallNotify one.
+	NotificationTypePreviewRecord NotificationType = "AGTPreviewRecord"
+	// NotificationTypeServerShutdown follows AGTSystemError E28921 that tells Proactive Contact is shutting down
+	// after a fatal error. Agent API has no stop message of its own, so it's not a keyword; the payload is the code.
+	// By the time it's delivered, the client rejects new commands, see WithServerShutdownLogoff.
+	NotificationTypeServerShutdown NotificationType = "ServerShutdown"
 )
 
-func processNotifications(r *request, notifications chan<- Notification) {
+// codeServerShutdown is the code of AGTSystemError sent when Proactive Contact is shutting down.
+const codeServerShutdown = "E28921"
+
+// NotificationOverflow is the policy applied when the notification channel is full.
+type NotificationOverflow int
+
+const (
+	// NotificationOverflowDropOldest drops the oldest notification in the channel to make room for the new one,
+	// it's the default policy.
+	NotificationOverflowDropOldest NotificationOverflow = iota
+	// NotificationOverflowDropNewest drops the notification that doesn't fit into the channel.
+	NotificationOverflowDropNewest
+	// NotificationOverflowUnbounded keeps undelivered notifications queued until the reader catches up, nothing is lost,
+	// but the queue isn't bounded: memory of a reader that has stalled grows without limit.
+	NotificationOverflowUnbounded
+)
+
+// notificationQueue delivers notifications into the channel of a subscriber according to NotificationOverflow policy,
+// push never blocks so publishing always keeps up with the main event loop.
+type notificationQueue struct {
+	ch      chan Notification
+	policy  NotificationOverflow
+	logger  *logger
+	pending []Notification
+}
+
+func newNotificationQueue(ch chan Notification, policy NotificationOverflow, logger *logger) *notificationQueue {
+	return &notificationQueue{ch: ch, policy: policy, logger: logger}
+}
+
+// push delivers the notification or handles the overflow.
+func (q *notificationQueue) push(n Notification) {
+	// Keep the order: nothing goes around already queued notifications
+	if len(q.pending) > 0 {
+		q.pending = append(q.pending, n)
+		return
+	}
+
+	select {
+	case q.ch <- n:
+		return
+	default:
+	}
+
+	switch q.policy {
+	case NotificationOverflowDropNewest:
+		q.logger.log(newLogEntry(LogLevelError, "Notification channel is full, dropping notification!", map[string]interface{}{"type": n.Type}))
+	case NotificationOverflowUnbounded:
+		q.pending = append(q.pending, n)
+	default:
+		select {
+		case dropped := <-q.ch:
+			q.logger.log(newLogEntry(LogLevelError, "Notification channel is full, dropping notification!", map[string]interface{}{"type": dropped.Type}))
+		default:
+		}
+
+		select {
+		case q.ch <- n:
+		default:
+		}
+	}
+}
+
+// out returns the channel to send the next queued notification to, it's nil when nothing is queued.
+func (q *notificationQueue) out() chan<- Notification {
+	if len(q.pending) == 0 {
+		return nil
+	}
+
+	return q.ch
+}
+
+// next returns the next queued notification.
+func (q *notificationQueue) next() Notification {
+	if len(q.pending) == 0 {
+		return Notification{}
+	}
+
+	return q.pending[0]
+}
+
+// processNotifications assembles notifications from events and publishes them until the request is done.
+func processNotifications(r *request, publish func(Notification), metrics Collector) {
 	var (
 		state   int
 		fields  map[string]string
@@ -317,14 +638,15 @@ func processNotifications(r *request, notifications chan<- Notification) {
 			switch {
 			case event.IsNotificationData():
 				switch NotificationType(event.Keyword) {
-				case NotificationTypeCallNotify:
+				case NotificationTypeCallNotify, NotificationTypePreviewRecord:
 					switch state {
 					case 0:
 						state++
 					case 1:
 						fields = make(map[string]string)
 						for _, s := range event.Segments[2:] {
-							parts := strings.Split(s, ",")
+							// Field data itself could contain commas
+							parts := strings.SplitN(s, ",", 2)
 							if len(parts) != 2 {
 								continue
 							}
@@ -333,16 +655,21 @@ func processNotifications(r *request, notifications chan<- Notification) {
 						}
 						state++
 					}
+				// Malformed data without the value is skipped, the notification is published empty
 				case NotificationTypeReceiveMessage:
-					message = event.Segments[2]
+					if len(event.Segments) > 2 {
+						message = event.Segments[2]
+					}
 				case NotificationTypeJobTransRequest:
-					jobName = event.Segments[2]
+					if len(event.Segments) > 2 {
+						jobName = event.Segments[2]
+					}
 				}
 			case event.IsSuccessfulNotification():
-				n := Notification{Type: NotificationType(event.Keyword)}
+				n := Notification{Type: NotificationType(event.Keyword), ReceivedAt: event.ReceivedAt}
 
 				switch n.Type {
-				case NotificationTypeCallNotify:
+				case NotificationTypeCallNotify, NotificationTypePreviewRecord:
 					n.Payload = fields
 					state = 0
 					fields = nil
@@ -354,9 +681,15 @@ func processNotifications(r *request, notifications chan<- Notification) {
 					jobName = ""
 				}
 
-				notifications <- n
+				metrics.NotificationReceived(n.Type)
+				publish(n)
 			case event.IsNotificationError():
-				notifications <- Notification{Type: NotificationType(event.Keyword), Payload: event.Segments[1]}
+				metrics.NotificationReceived(NotificationType(event.Keyword))
+				publish(Notification{Type: NotificationType(event.Keyword), Payload: event.Segments[1], ReceivedAt: event.ReceivedAt})
+
+				if NotificationType(event.Keyword) == NotificationTypeSystemError && event.Segments[1] == codeServerShutdown {
+					publish(Notification{Type: NotificationTypeServerShutdown, Payload: event.Segments[1], ReceivedAt: event.ReceivedAt})
+				}
 			}
 		case <-r.context.Done():
 			return
@@ -0,0 +1,340 @@
+package apc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProcessRequest_Incomplete(t *testing.T) {
+	r := newRequest(context.Background(), nil)
+	r.eventChan = make(chan Event, 3)
+
+	r.eventChan <- Event{Keyword: "AGTListJobs", Type: EventTypeData, Segments: []string{"0", "M00001", "O,outbnd1,A", "I,inbnd1,A"}, IsIncomplete: true}
+	r.eventChan <- Event{Keyword: "AGTListJobs", Type: EventTypeData, Segments: []string{"0", "B,blend1,I"}}
+	r.eventChan <- Event{Keyword: "AGTListJobs", Type: EventTypeResponse, Segments: []string{"0", "M00000"}}
+
+	got, err := processRequest(r)
+	if err != nil {
+		t.Fatalf("processRequest() error = %v", err)
+	}
+
+	want := []string{"M00001", "O,outbnd1,A", "I,inbnd1,A", "0", "B,blend1,I"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("processRequest() = %q, want %q", got, want)
+	}
+}
+
+func TestProcessRequest_IncompleteWithoutContinuation(t *testing.T) {
+	r := newRequest(context.Background(), nil)
+
+	r.eventChan <- Event{Keyword: "AGTListJobs", Type: EventTypeData, Segments: []string{"0", "M00001", "O,outbnd1,A"}, IsIncomplete: true}
+	r.eventChan <- Event{Keyword: "AGTListJobs", Type: EventTypeResponse, Segments: []string{"0", "M00000"}}
+
+	if _, err := processRequest(r); err != ErrIncompleteResponse {
+		t.Errorf("processRequest() error = %v, want %v", err, ErrIncompleteResponse)
+	}
+}
+
+func TestProcessRequest_Error(t *testing.T) {
+	r := newRequest(context.Background(), nil)
+	r.eventChan <- Event{Keyword: "AGTSetCallback", Type: EventTypeResponse, Segments: []string{"1", "E28800", "30"}}
+
+	_, err := processRequest(r)
+
+	var apcErr APCError
+	if !errors.As(err, &apcErr) {
+		t.Fatalf("processRequest() error = %v, want APCError", err)
+	}
+
+	want := APCError{Keyword: "AGTSetCallback", Code: "E28800", Message: "30"}
+	if apcErr != want {
+		t.Errorf("processRequest() error = %#v, want %#v", apcErr, want)
+	}
+
+	wrapped := fmt.Errorf("cannot schedule: %w", err)
+	if !errors.Is(wrapped, APCError{Code: "E28800"}) {
+		t.Errorf("errors.Is(%v, E28800) = false, want true", wrapped)
+	}
+	if errors.Is(wrapped, APCError{Code: "E28800", Keyword: "AGTAttachJob"}) {
+		t.Errorf("errors.Is(%v, AGTAttachJob E28800) = true, want false", wrapped)
+	}
+	if errors.Is(wrapped, APCError{Code: "E28885"}) {
+		t.Errorf("errors.Is(%v, E28885) = true, want false", wrapped)
+	}
+}
+
+func TestDecodeEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    Event
+		wantErr bool
+	}{
+		{
+			name: "Response",
+			raw:  string(encodeEvent("AGTLogon", EventTypeResponse, 12, "0", "M00000")),
+			want: Event{Keyword: "AGTLogon", Type: EventTypeResponse, Client: "Agent server", ProcessID: 1539, InvokeID: 12, Segments: []string{"0", "M00000"}},
+		},
+		{
+			name: "Incomplete",
+			raw:  strings.TrimSuffix(string(encodeEvent("AGTListJobs", EventTypeData, 7, "0", "M00001", "O,outbnd1,A")), string(ETX)) + string(ETB),
+			want: Event{Keyword: "AGTListJobs", Type: EventTypeData, Client: "Agent server", ProcessID: 1539, InvokeID: 7, Segments: []string{"0", "M00001", "O,outbnd1,A"}, IsIncomplete: true},
+		},
+		{
+			name: "Command",
+			raw:  "AGTReadyNextItem    CCOriginator_ID      11111 1   0   \x03",
+			want: Event{Keyword: "AGTReadyNextItem", Type: EventTypeCommand, Client: "COriginator_ID", ProcessID: 11111, InvokeID: 1},
+		},
+		{name: "Empty", raw: "", wantErr: true},
+		{name: "Short", raw: "AGTLogon            R\x03", wantErr: true},
+		{name: "ProcessID", raw: "AGTLogon            RAgent server        pid   12  2   \x1e0\x1eM00000\x03", wantErr: true},
+		{name: "InvokeID", raw: "AGTLogon            RAgent server        1539  id  2   \x1e0\x1eM00000\x03", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeEvent(tt.raw)
+			if tt.wantErr {
+				if !IsDecodingError(err) {
+					t.Errorf("DecodeEvent() error = %v, want decoding error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecodeEvent() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeEvent() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzDecodeEvent(f *testing.F) {
+	f.Add(string(encodeEvent("AGTLogon", EventTypeResponse, 12, "0", "M00000")))
+	f.Add(string(encodeEvent("AGTCallNotify", EventTypeNotification, 0, "0", "M00001", "CURPHONE,01")))
+	f.Add("AGTSTART            NAgent server        17970 0   2   \x1e0\x1eAGENT_STARTUP\x03")
+	f.Add("AGTReadyNextItem    CCOriginator_ID      11111 1   0   \x03")
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		event, err := DecodeEvent(raw)
+		if err != nil {
+			if !IsDecodingError(err) {
+				t.Fatalf("DecodeEvent() error = %v, want decoding error", err)
+			}
+			return
+		}
+
+		if len(event.Keyword) > 20 || len(event.Client) > 20 {
+			t.Errorf("DecodeEvent() = %+v, keyword and client are limited to 20 bytes", event)
+		}
+	})
+}
+
+// emptyReader returns empty reads the given number of times before reading from the underlying reader.
+type emptyReader struct {
+	r     io.Reader
+	empty int
+}
+
+func (r *emptyReader) Read(p []byte) (int, error) {
+	if r.empty > 0 {
+		r.empty--
+		return 0, nil
+	}
+
+	return r.r.Read(p)
+}
+
+func TestFrameReader_EmptyReads(t *testing.T) {
+	raw := encodeEvent("AGTLogon", EventTypeResponse, 12, "0", "M00000")
+	frames := newFrameReader(&emptyReader{r: bytes.NewReader(raw), empty: 3})
+
+	frame, err := frames.next()
+	if err != nil {
+		t.Fatalf("next() error = %v", err)
+	}
+	event, err := DecodeEvent(frame)
+	if err != nil {
+		t.Fatalf("DecodeEvent() error = %v", err)
+	}
+	if event.Keyword != "AGTLogon" || event.InvokeID != 12 || !event.IsSuccessfulResponse() {
+		t.Errorf("DecodeEvent() = %+v, want successful AGTLogon response", event)
+	}
+
+	if _, err := frames.next(); err != io.EOF {
+		t.Errorf("next() error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestFrameReader_NoProgress(t *testing.T) {
+	frames := newFrameReader(&emptyReader{r: bytes.NewReader(nil), empty: math.MaxInt})
+
+	if _, err := frames.next(); err != io.ErrNoProgress {
+		t.Errorf("next() error = %v, want %v", err, io.ErrNoProgress)
+	}
+}
+
+// FuzzFrames runs the received stream through the same path as the client does: frames are split, decoded,
+// merged and assembled into notifications, none of it may panic.
+func FuzzFrames(f *testing.F) {
+	f.Add(encodeEvent("AGTLogon", EventTypeResponse, 12, "0", "M00000"))
+	f.Add(bytes.Join([][]byte{
+		encodeEvent("AGTCallNotify", EventTypeNotification, 0, "0", "M00001", "0000000001", "OUTBOUND"),
+		encodeEvent("AGTCallNotify", EventTypeNotification, 0, "0", "M00001", "CURPHONE,01", "NAME"),
+		encodeEvent("AGTCallNotify", EventTypeNotification, 0, "0", "M00000"),
+	}, nil))
+	f.Add(encodeEvent("AGTSystemError", EventTypeNotification, 0, "1", "E28921"))
+	// Regression: data of these notifications without the value used to index out of range
+	f.Add(encodeEvent("AGTReceiveMessage", EventTypeNotification, 0, "0", "M00001"))
+	f.Add(encodeEvent("AGTJobTransRequest", EventTypeNotification, 0, "0", "M00001"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := newRequest(context.Background(), nil)
+		defer r.cancel()
+
+		// The last notification tells all the previous ones have been processed;
+		// its keyword is longer than 20 bytes, so it can't be decoded from the input
+		const last NotificationType = "FUZZ_LAST_NOTIFICATION"
+		processed := make(chan struct{})
+		go processNotifications(r, func(n Notification) {
+			if n.Type == last {
+				close(processed)
+			}
+		}, nopCollector{})
+
+		frames := newFrameReader(bytes.NewReader(data))
+		blocks := make(blockMerger)
+		for {
+			raw, err := frames.next()
+			if err != nil {
+				break
+			}
+
+			event, err := DecodeEvent(raw)
+			if err != nil {
+				continue
+			}
+			for _, event := range blocks.merge(event) {
+				if event.Type == EventTypeNotification {
+					r.eventChan <- event
+				}
+			}
+		}
+
+		r.eventChan <- Event{Keyword: string(last), Type: EventTypeNotification, Segments: []string{"0", "M00000"}}
+		<-processed
+	})
+}
+
+func TestServerInfo(t *testing.T) {
+	raw := "AGTSTART            NAgent server        17970 0   2   \x1e0\x1eAGENT_STARTUP\x03"
+
+	event, err := DecodeEvent(raw)
+	if err != nil {
+		t.Fatalf("DecodeEvent() error = %v", err)
+	}
+
+	got, err := serverInfo(event)
+	if err != nil {
+		t.Fatalf("serverInfo() error = %v", err)
+	}
+
+	want := ServerInfo{Name: "Agent server", ProcessID: 17970, Message: "AGENT_STARTUP", Extra: []string{}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("serverInfo() = %#v, want %#v", got, want)
+	}
+}
+
+func TestServerInfo_NotStart(t *testing.T) {
+	event := Event{Keyword: "AGTSystemError", Type: EventTypeNotification, Segments: []string{"1", "E28858", "agent"}}
+
+	if _, err := serverInfo(event); err != ErrHelloNotReceived {
+		t.Errorf("serverInfo() error = %v, want %v", err, ErrHelloNotReceived)
+	}
+}
+
+func TestProcessNotifications_PreviewRecord(t *testing.T) {
+	r := newRequest(context.Background(), nil)
+	r.eventChan = make(chan Event, 3)
+
+	r.eventChan <- Event{Keyword: "AGTPreviewRecord", Type: EventTypeNotification, Segments: []string{"0", "M00001", "Home phone - 2037538811 (Preview)", "MANAGED", "DEBT_ID,1005"}}
+	r.eventChan <- Event{Keyword: "AGTPreviewRecord", Type: EventTypeNotification, Segments: []string{"0", "M00001", "NAME,JOHN DOE", "ADDRESS,1 Main St, Apt 2"}}
+	r.eventChan <- Event{Keyword: "AGTPreviewRecord", Type: EventTypeNotification, Segments: []string{"0", "M00000"}}
+
+	notifications := make(chan Notification, 1)
+	go processNotifications(r, func(n Notification) { notifications <- n }, nopCollector{})
+	defer r.cancel()
+
+	n := <-notifications
+
+	want := Notification{
+		Type:    NotificationTypePreviewRecord,
+		Payload: map[string]string{"NAME": "JOHN DOE", "ADDRESS": "1 Main St, Apt 2"},
+	}
+	if !reflect.DeepEqual(n, want) {
+		t.Errorf("notification = %#v, want %#v", n, want)
+	}
+}
+
+func TestBlockMerger(t *testing.T) {
+	blocks := make(blockMerger)
+
+	raws := []string{
+		string(encodeEvent("AGTListJobs", EventTypeData, 7, "0", "M00001", "O,outbnd1,A")),
+		string(encodeEvent("AGTListJobs", EventTypeData, 7, "I,inbnd1,A", "B,blend1,I")),
+		string(encodeEvent("AGTListJobs", EventTypeData, 7, "M,managed1,A")),
+	}
+	// The first two blocks are terminated by ETB
+	for i := 0; i < 2; i++ {
+		raws[i] = strings.TrimSuffix(raws[i], string(ETX)) + string(ETB)
+	}
+
+	var merged []Event
+	for _, raw := range raws {
+		event, err := DecodeEvent(raw)
+		if err != nil {
+			t.Fatalf("DecodeEvent() error = %v", err)
+		}
+
+		merged = append(merged, blocks.merge(event)...)
+	}
+
+	if len(merged) != 1 {
+		t.Fatalf("merged %d events, want 1", len(merged))
+	}
+
+	want := []string{"0", "M00001", "O,outbnd1,A", "I,inbnd1,A", "B,blend1,I", "M,managed1,A"}
+	if got := merged[0]; !reflect.DeepEqual(got.Segments, want) || got.IsIncomplete || got.InvokeID != 7 {
+		t.Errorf("merged event = %+v, want complete event 7 with segments %q", got, want)
+	}
+	if len(blocks) != 0 {
+		t.Errorf("%d incomplete messages left, want none", len(blocks))
+	}
+}
+
+func TestFieldChanges(t *testing.T) {
+	var published []Notification
+	f := &fieldChanges{publish: func(n Notification) { published = append(published, n) }}
+
+	f.track(Notification{Type: NotificationTypeCallNotify, Payload: map[string]string{"CURPHONE": "01", "NAME": "JOHN DOE", "BALANCE": "1500"}})
+	f.track(Notification{Type: NotificationTypeAutoReleaseLine})
+	f.track(Notification{Type: NotificationTypeCallNotify, Payload: map[string]string{"CURPHONE": "02", "NAME": "JOHN DOE", "DUEDATE": "2024/03/15"}})
+
+	want := [][]string{
+		{"BALANCE", "CURPHONE", "NAME"},
+		nil,
+		{"BALANCE", "CURPHONE", "DUEDATE"},
+	}
+	for i, n := range published {
+		if !reflect.DeepEqual(n.Changed, want[i]) {
+			t.Errorf("notification %d %s changed = %v, want %v", i, n.Type, n.Changed, want[i])
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package apc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Credentials describes the agent session opened by AgentSession.
+type Credentials struct {
+	AgentName string
+	Password  string
+	HeadsetID int
+	JobName   string
+	// DataFields of outbound calling list to be sent with call notifications, see SetDataField
+	DataFields []string
+}
+
+// TeardownError is returned by AgentSession.Close when some of teardown steps have failed.
+type TeardownError struct {
+	Errors []error
+}
+
+func (e *TeardownError) Error() string {
+	texts := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		texts = append(texts, err.Error())
+	}
+
+	return "teardown has failed: " + strings.Join(texts, "; ")
+}
+
+// Unwrap returns errors of failed steps to support errors.Is and errors.As.
+func (e *TeardownError) Unwrap() []error {
+	return e.Errors
+}
+
+// sessionStep is the teardown step of AgentSession.
+type sessionStep struct {
+	keyword string
+	undo    func(context.Context) error
+}
+
+// AgentSession manages the typical agent lifecycle on top of Client:
+// logon, headset reservation and connection, job attachment and availability for work.
+type AgentSession struct {
+	client *Client
+	// credentials of the opened session, they are replayed by Resume
+	creds *Credentials
+
+	// teardown steps of the successfully executed commands in order of execution
+	steps []sessionStep
+	mu    sync.Mutex
+}
+
+// NewAgentSession returns AgentSession that works through the started Client.
+func NewAgentSession(client *Client) *AgentSession {
+	return &AgentSession{client: client}
+}
+
+// Open logs on the agent, reserves and connects the headset, attaches the job, sets data fields
+// and makes the agent available for work. If any step fails, the already done steps are unwound.
+// The session that is already open must be closed first, otherwise ErrSessionOpen is returned.
+func (s *AgentSession) Open(ctx context.Context, creds Credentials) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.steps) > 0 {
+		return ErrSessionOpen
+	}
+
+	return s.open(ctx, creds)
+}
+
+// Resume opens the session again through the new client, e.g. after the connection of the previous one was lost
+// and the caller has reconnected: the agent is logged on, the headset is reserved and connected, the job is attached
+// and data fields are set with the credentials of the last Open. Nothing is unwound on the previous client,
+// its server has dropped the session along with the connection. The error is the same as of Open.
+//
+// Resume isn't called automatically: Client is a single connection and has no reconnect of its own, the caller creates
+// and starts the new one, so there is no reconnect handshake inside the client to replay the session after.
+// For the same reason a failed replay step isn't published as a notification: notifications are delivered
+// per Client, the previous one is closed and nobody has subscribed to the new one yet, so the step is named
+// in the returned error instead.
+func (s *AgentSession) Resume(ctx context.Context, client *Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.creds == nil {
+		return fmt.Errorf("cannot resume session: it has never been opened")
+	}
+
+	s.client = client
+	s.steps = nil
+
+	return s.open(ctx, *s.creds)
+}
+
+func (s *AgentSession) open(ctx context.Context, creds Credentials) error {
+	s.creds = &creds
+
+	c := s.client
+	steps := []struct {
+		keyword string
+		do      func() error
+		undo    func(context.Context) error
+	}{
+		{"AGTLogon", func() error { return c.Logon(ctx, creds.AgentName, creds.Password) }, c.Logoff},
+		{"AGTReserveHeadset", func() error { return c.ReserveHeadset(ctx, creds.HeadsetID) }, c.FreeHeadset},
+		{"AGTConnHeadset", func() error { return c.ConnectHeadset(ctx) }, c.DisconnectHeadset},
+		{"AGTAttachJob", func() error { return c.AttachJob(ctx, creds.JobName) }, c.DetachJob},
+		{"AGTSetDataField", func() error {
+			if len(creds.DataFields) == 0 {
+				return nil
+			}
+			return c.SetDataFields(ctx, ListTypeOutbound, creds.DataFields...)
+		}, nil},
+		{"AGTAvailWork", func() error { return c.AvailWork(ctx) }, c.NoFurtherWork},
+	}
+
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			err = fmt.Errorf("cannot open session on %s: %w", step.keyword, err)
+			if teardownErr := s.close(ctx); teardownErr != nil {
+				return fmt.Errorf("%w (%v)", err, teardownErr)
+			}
+			return err
+		}
+
+		if step.undo != nil {
+			s.steps = append(s.steps, sessionStep{keyword: step.keyword, undo: step.undo})
+		}
+	}
+
+	return nil
+}
+
+// Close unwinds the opened session in the reverse order. It's best-effort: all the steps are executed
+// even if some of them fail, in this case the error is *TeardownError.
+func (s *AgentSession) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.close(ctx)
+}
+
+func (s *AgentSession) close(ctx context.Context) error {
+	var errs []error
+	for i := len(s.steps) - 1; i >= 0; i-- {
+		if err := s.steps[i].undo(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("cannot undo %s: %w", s.steps[i].keyword, err))
+		}
+	}
+	s.steps = nil
+
+	if len(errs) > 0 {
+		return &TeardownError{Errors: errs}
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package apc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAgentSession(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	session := NewAgentSession(c)
+	err := session.Open(context.Background(), Credentials{
+		AgentName:  "agent",
+		Password:   "password",
+		HeadsetID:  32774,
+		JobName:    "TEST_JOB",
+		DataFields: []string{"DEBT_ID", "CURPHONE"},
+	})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	want := []string{"AGTLogon", "AGTReserveHeadset", "AGTConnHeadset", "AGTAttachJob", "AGTSetDataField", "AGTSetDataField", "AGTAvailWork"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("server received %v on open, want %v", got, want)
+	}
+
+	if err := session.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	want = []string{"AGTNoFurtherWork", "AGTDetachJob", "AGTDisconnHeadset", "AGTFreeHeadset", "AGTLogoff"}
+	if got := s.keywords()[7:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v on close, want %v", got, want)
+	}
+}
+
+func TestAgentSession_OpenTwice(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s)
+
+	session := NewAgentSession(c)
+	creds := Credentials{AgentName: "agent", Password: "password", JobName: "TEST_JOB"}
+	if err := session.Open(context.Background(), creds); err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	opened := len(s.keywords())
+	if err := session.Open(context.Background(), creds); !errors.Is(err, ErrSessionOpen) {
+		t.Fatalf("second Open() error = %v, want ErrSessionOpen", err)
+	}
+	if got := s.keywords(); len(got) != opened {
+		t.Errorf("server received %v after the second Open, want nothing", got[opened:])
+	}
+
+	// Only the steps of the first Open are unwound
+	if err := session.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	want := []string{"AGTNoFurtherWork", "AGTDetachJob", "AGTDisconnHeadset", "AGTFreeHeadset", "AGTLogoff"}
+	if got := s.keywords()[opened:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v on close, want %v", got, want)
+	}
+}
+
+func TestAgentSession_OpenFailure(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if cmd.Keyword == "AGTAttachJob" {
+			conn.respond(cmd, "1", "E28889")
+			return
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	session := NewAgentSession(c)
+	err := session.Open(context.Background(), Credentials{AgentName: "agent", Password: "password", JobName: "TEST_JOB"})
+	if !errors.Is(err, APCError{Code: "E28889"}) {
+		t.Fatalf("Open() error = %v, want E28889", err)
+	}
+
+	want := []string{"AGTLogon", "AGTReserveHeadset", "AGTConnHeadset", "AGTAttachJob", "AGTDisconnHeadset", "AGTFreeHeadset", "AGTLogoff"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestAgentSession_OpenFailure_ConnectHeadset(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if cmd.Keyword == "AGTConnHeadset" {
+			conn.respond(cmd, "1", "E28875")
+			return
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	session := NewAgentSession(c)
+	err := session.Open(context.Background(), Credentials{AgentName: "agent", Password: "password", HeadsetID: 1, JobName: "TEST_JOB"})
+	if !errors.Is(err, APCError{Code: "E28875"}) {
+		t.Fatalf("Open() error = %v, want E28875", err)
+	}
+
+	// The reservation is undone by AGTFreeHeadset, there is nothing to disconnect
+	want := []string{"AGTLogon", "AGTReserveHeadset", "AGTConnHeadset", "AGTFreeHeadset", "AGTLogoff"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
+
+func TestAgentSession_CloseFailure(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		switch cmd.Keyword {
+		case "AGTDetachJob":
+			conn.respond(cmd, "1", "E28885")
+		case "AGTFreeHeadset":
+			conn.respond(cmd, "1", "E28867")
+		default:
+			respondOK(conn, cmd)
+		}
+	})
+	c, _ := newTestClient(t, s)
+
+	session := NewAgentSession(c)
+	if err := session.Open(context.Background(), Credentials{AgentName: "agent", Password: "password", JobName: "TEST_JOB"}); err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	err := session.Close(context.Background())
+
+	var teardownErr *TeardownError
+	if !errors.As(err, &teardownErr) || len(teardownErr.Errors) != 2 {
+		t.Fatalf("Close() error = %v, want TeardownError w/ 2 errors", err)
+	}
+	if !errors.Is(err, APCError{Code: "E28885"}) || !errors.Is(err, APCError{Code: "E28867"}) {
+		t.Errorf("Close() error = %v, want E28885 and E28867", err)
+	}
+
+	// All steps must be executed despite failures
+	if got := s.keywords(); got[len(got)-1] != "AGTLogoff" {
+		t.Errorf("server received %v, want AGTLogoff last", got)
+	}
+}
+
+func TestAgentSession_Resume(t *testing.T) {
+	creds := Credentials{AgentName: "agent", Password: "password", HeadsetID: 32774, JobName: "TEST_JOB", DataFields: []string{"DEBT_ID"}}
+	want := []string{"AGTLogon", "AGTReserveHeadset", "AGTConnHeadset", "AGTAttachJob", "AGTSetDataField", "AGTAvailWork"}
+
+	first := newMockServer(t, respondOK)
+	c, done := newTestClient(t, first)
+
+	session := NewAgentSession(c)
+	if err := session.Open(context.Background(), creds); err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	// The connection is lost in the middle of the session
+	first.close()
+	if err := waitStart(t, done); err == nil {
+		t.Fatal("Start() error = nil, want connection error")
+	}
+
+	second := newMockServer(t, respondOK)
+	reconnected, _ := newTestClient(t, second)
+
+	if err := session.Resume(context.Background(), reconnected); err != nil {
+		t.Fatalf("Resume() error = %v", err)
+	}
+	if got := second.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v on resume, want %v", got, want)
+	}
+
+	// Nothing is unwound through the lost connection
+	if got := first.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("first server received %v, want %v", got, want)
+	}
+
+	// The whole state is re-established with the credentials of Open
+	received := second.received()
+	wantSegments := [][]string{
+		{"agent", "password", "GOLANG_0.0.3"},
+		{"32774"},
+		nil,
+		{"TEST_JOB"},
+		{"O", "DEBT_ID"},
+		nil,
+	}
+	for i, segments := range wantSegments {
+		got := received[i].Segments
+		if len(got) == 0 && len(segments) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, segments) {
+			t.Errorf("%s segments = %v, want %v", received[i].Keyword, got, segments)
+		}
+	}
+	if got := reconnected.HeadsetStatus(); got != HeadsetConnected {
+		t.Errorf("HeadsetStatus() = %v, want %v", got, HeadsetConnected)
+	}
+
+	// The resumed session is closed through the new client
+	if err := session.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := second.keywords(); got[len(got)-1] != "AGTLogoff" {
+		t.Errorf("server received %v, want AGTLogoff last", got)
+	}
+}
+
+func TestAgentSession_ResumeFailure(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if cmd.Keyword == "AGTAttachJob" {
+			conn.respond(cmd, "1", "E28889")
+			return
+		}
+		respondOK(conn, cmd)
+	})
+	c, _ := newTestClient(t, s)
+
+	session := NewAgentSession(c)
+	if err := session.Resume(context.Background(), c); err == nil {
+		t.Fatal("Resume() error = nil for the session that has never been opened")
+	}
+
+	session.creds = &Credentials{AgentName: "agent", Password: "password", JobName: "TEST_JOB"}
+	err := session.Resume(context.Background(), c)
+	if !errors.Is(err, APCError{Code: "E28889"}) {
+		t.Fatalf("Resume() error = %v, want E28889", err)
+	}
+	// The failed step is reported by the error, there is no notification of it
+	if !strings.Contains(err.Error(), "AGTAttachJob") {
+		t.Errorf("Resume() error = %v, want the failed step named", err)
+	}
+
+	// Replayed steps are unwound as on a failed Open
+	want := []string{"AGTLogon", "AGTReserveHeadset", "AGTConnHeadset", "AGTAttachJob", "AGTDisconnHeadset", "AGTFreeHeadset", "AGTLogoff"}
+	if got := s.keywords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("server received %v, want %v", got, want)
+	}
+}
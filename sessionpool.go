@@ -0,0 +1,157 @@
+package apc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// AgentNotification is the notification of the agent session in SessionPool.
+type AgentNotification struct {
+	AgentName string
+	Notification
+}
+
+// poolEntry is the client of an agent in SessionPool and the cancel func of its notification forwarding.
+type poolEntry struct {
+	client *Client
+	cancel context.CancelFunc
+}
+
+// stop cancels forwarding of notifications and stops the client.
+func (e *poolEntry) stop() {
+	e.cancel()
+	e.client.Stop()
+}
+
+// SessionPool holds started clients of many agents: commands are routed to the client of an agent by its name,
+// notifications of all the clients are merged into one channel with the agent name attached.
+// Clients are independent, one of them could be replaced (e.g. after a reconnect) without affecting others.
+type SessionPool struct {
+	mu      sync.RWMutex
+	entries map[string]*poolEntry
+	closed  bool
+
+	notifications chan AgentNotification
+	// forwarders of notifications; the channel is closed once all of them exit
+	wg sync.WaitGroup
+}
+
+// NewSessionPool returns an empty SessionPool.
+func NewSessionPool() *SessionPool {
+	return &SessionPool{
+		entries:       make(map[string]*poolEntry),
+		notifications: make(chan AgentNotification),
+	}
+}
+
+// Add adds the started client of the agent to the pool. The client that the agent already has is stopped
+// and replaced, so a reconnected agent is added again with its new client.
+func (p *SessionPool) Add(agentName string, client *Client) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return fmt.Errorf("cannot add agent %s: %w", agentName, ErrConnectionClosed)
+	}
+
+	old, replaced := p.entries[agentName]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	notifications, _ := client.Subscribe(ctx)
+	p.entries[agentName] = &poolEntry{client: client, cancel: cancel}
+
+	p.wg.Add(1)
+	go p.forward(ctx, agentName, notifications)
+	p.mu.Unlock()
+
+	// The graceful logoff of the old client mustn't hold up other agents
+	if replaced {
+		old.stop()
+	}
+
+	return nil
+}
+
+// forward passes notifications of the agent to the pool channel until the subscription is over.
+func (p *SessionPool) forward(ctx context.Context, agentName string, notifications <-chan Notification) {
+	defer p.wg.Done()
+
+	for n := range notifications {
+		select {
+		case p.notifications <- AgentNotification{AgentName: agentName, Notification: n}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Client returns the client of the agent to execute commands through; it returns ErrUnknownAgent
+// if the agent isn't in the pool.
+func (p *SessionPool) Client(agentName string) (*Client, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	entry, ok := p.entries[agentName]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAgent, agentName)
+	}
+
+	return entry.client, nil
+}
+
+// Agents returns sorted names of agents in the pool.
+func (p *SessionPool) Agents() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	agents := make([]string, 0, len(p.entries))
+	for agentName := range p.entries {
+		agents = append(agents, agentName)
+	}
+	sort.Strings(agents)
+
+	return agents
+}
+
+// Remove stops the client of the agent and removes it from the pool.
+func (p *SessionPool) Remove(agentName string) error {
+	p.mu.Lock()
+	entry, ok := p.entries[agentName]
+	delete(p.entries, agentName)
+	p.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownAgent, agentName)
+	}
+	entry.stop()
+
+	return nil
+}
+
+// Notifications returns the channel of notifications of all the agents in the pool.
+// The channel is closed by Close.
+func (p *SessionPool) Notifications() <-chan AgentNotification {
+	return p.notifications
+}
+
+// Close stops all the clients and closes the notification channel. It is safe to call Close several times.
+func (p *SessionPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+
+	entries := p.entries
+	p.entries = make(map[string]*poolEntry)
+	p.mu.Unlock()
+
+	for _, entry := range entries {
+		entry.stop()
+	}
+
+	p.wg.Wait()
+	close(p.notifications)
+}
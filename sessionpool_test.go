@@ -0,0 +1,153 @@
+package apc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionPool(t *testing.T) {
+	first := newMockServer(t, respondOK)
+	second := newMockServer(t, func(conn *mockConn, cmd Event) {
+		respondOK(conn, cmd)
+		conn.send("AGTJobEnd", EventTypeNotification, 0, "0", "M00000")
+	})
+	firstClient, _ := newTestClient(t, first)
+	secondClient, _ := newTestClient(t, second)
+
+	pool := NewSessionPool()
+	t.Cleanup(pool.Close)
+	if err := pool.Add("agent1", firstClient); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := pool.Add("agent2", secondClient); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	if got := pool.Agents(); !reflect.DeepEqual(got, []string{"agent1", "agent2"}) {
+		t.Errorf("Agents() = %v, want [agent1 agent2]", got)
+	}
+
+	c, err := pool.Client("agent2")
+	if err != nil {
+		t.Fatalf("Client() error = %v", err)
+	}
+	if err := c.AttachJob(context.Background(), "TEST_JOB"); err != nil {
+		t.Fatalf("AttachJob() error = %v", err)
+	}
+
+	// The command is routed to the agent's server only
+	if got := second.keywords(); !reflect.DeepEqual(got, []string{"AGTAttachJob"}) {
+		t.Errorf("agent2 server received %v, want [AGTAttachJob]", got)
+	}
+	if got := first.keywords(); len(got) != 0 {
+		t.Errorf("agent1 server received %v, want nothing", got)
+	}
+
+	select {
+	case n := <-pool.Notifications():
+		if n.AgentName != "agent2" || n.Type != NotificationTypeJobEnd {
+			t.Errorf("Notifications() = %+v, want AGTJobEnd of agent2", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pool hasn't received a notification")
+	}
+
+	if _, err := pool.Client("agent3"); !errors.Is(err, ErrUnknownAgent) {
+		t.Errorf("Client() error = %v, want %v", err, ErrUnknownAgent)
+	}
+}
+
+func TestSessionPool_Replace(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		respondOK(conn, cmd)
+		conn.send("AGTJobEnd", EventTypeNotification, 0, "0", "M00000")
+	})
+	oldClient, _ := newTestClient(t, s)
+	otherClient, _ := newTestClient(t, s)
+	newClient, _ := newTestClient(t, s)
+
+	pool := NewSessionPool()
+	_ = pool.Add("agent1", oldClient)
+	_ = pool.Add("agent2", otherClient)
+
+	// Reconnect of agent1 stops only its old client
+	_ = pool.Add("agent1", newClient)
+
+	select {
+	case <-oldClient.Done():
+	case <-time.After(time.Second):
+		t.Fatal("replaced client hasn't been stopped")
+	}
+
+	for _, agentName := range []string{"agent1", "agent2"} {
+		c, err := pool.Client(agentName)
+		if err != nil {
+			t.Fatalf("Client() error = %v", err)
+		}
+		if err := c.AttachJob(context.Background(), "TEST_JOB"); err != nil {
+			t.Errorf("AttachJob() of %s error = %v", agentName, err)
+		}
+
+		select {
+		case n := <-pool.Notifications():
+			if n.AgentName != agentName {
+				t.Errorf("Notifications() = %+v, want notification of %s", n, agentName)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("pool hasn't received a notification of %s", agentName)
+		}
+	}
+
+	pool.Close()
+	if _, ok := <-pool.Notifications(); ok {
+		t.Error("Notifications() channel is open after Close")
+	}
+	if err := pool.Add("agent3", newClient); err == nil {
+		t.Error("Add() error = nil after Close")
+	}
+}
+
+func TestSessionPool_RemoveDoesNotBlock(t *testing.T) {
+	// The server of agent1 never answers, so its graceful logoff lasts until the timeout
+	slow := newMockServer(t, nil)
+	slowClient, _ := newTestClient(t, slow, WithGracefulLogoff(500*time.Millisecond))
+	s := newMockServer(t, respondOK)
+	otherClient, _ := newTestClient(t, s)
+
+	pool := NewSessionPool()
+	defer pool.Close()
+	_ = pool.Add("agent1", slowClient)
+	_ = pool.Add("agent2", otherClient)
+
+	removed := make(chan error, 1)
+	go func() {
+		removed <- pool.Remove("agent1")
+	}()
+	for len(slow.keywords()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Other agents are served while agent1 is logging off
+	looked := make(chan error, 1)
+	go func() {
+		_, err := pool.Client("agent2")
+		looked <- err
+	}()
+	select {
+	case err := <-looked:
+		if err != nil {
+			t.Errorf("Client() error = %v", err)
+		}
+	case <-removed:
+		t.Fatal("Client() has waited for Remove()")
+	case <-time.After(250 * time.Millisecond):
+		t.Fatal("Client() is blocked by Remove()")
+	}
+
+	if err := <-removed; err != nil {
+		t.Errorf("Remove() error = %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package apc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProtocolVersion is the version of Agent API spoken by the server, e.g. 5.1.0.0.4:
+// major, minor, service pack, repack and build numbers. The zero value means the version is unknown,
+// then commands are encoded the way that every server accepts.
+type ProtocolVersion [5]int
+
+// protocolVersionPCAPI is the first version that tells functionality of clients apart by AgentAPIVersion of AGTLogon.
+var protocolVersionPCAPI = ProtocolVersion{5, 1, 0, 0, 4}
+
+// ParseProtocolVersion parses the version formatted as "5.1.0.0.4" or as AgentAPIVersion "PCAPI_5.1.0.0.4";
+// missing trailing numbers are zeros, e.g. "5.2" is 5.2.0.0.0.
+func ParseProtocolVersion(s string) (ProtocolVersion, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "PCAPI_"), ".")
+	if len(parts) > len(ProtocolVersion{}) {
+		return ProtocolVersion{}, fmt.Errorf("invalid protocol version %q", s)
+	}
+
+	var v ProtocolVersion
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return ProtocolVersion{}, fmt.Errorf("invalid protocol version %q", s)
+		}
+		v[i] = n
+	}
+
+	return v, nil
+}
+
+// String returns the version formatted as "5.1.0.0.4".
+func (v ProtocolVersion) String() string {
+	parts := make([]string, len(v))
+	for i, n := range v {
+		parts[i] = strconv.Itoa(n)
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// IsZero tells whether the version is unknown.
+func (v ProtocolVersion) IsZero() bool {
+	return v == ProtocolVersion{}
+}
+
+// AtLeast tells whether the version is the same as or newer than the other one.
+func (v ProtocolVersion) AtLeast(other ProtocolVersion) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] > other[i]
+		}
+	}
+
+	return true
+}
+
+// protocolVersionOf detects the version from extra segments of AGTSTART banner, the banner of Agent API 5.2
+// has none, so the version is usually unknown unless it's set by WithProtocolVersion.
+func protocolVersionOf(info ServerInfo) ProtocolVersion {
+	for _, segment := range info.Extra {
+		if v, err := ParseProtocolVersion(strings.TrimSpace(segment)); err == nil && !v.IsZero() {
+			return v
+		}
+	}
+
+	return ProtocolVersion{}
+}
+
+// adaptArgs adapts arguments of the command to the protocol version before it's encoded.
+// Divergences between versions are kept here, so the methods build their commands the same way for every server.
+//
+// AGTLogon: servers since 5.1.0.0.4 enable newer functionality for clients sending AgentAPIVersion formatted
+// as PCAPI_<version>, older ones don't know this format, so they get the client identifier as before.
+func (v ProtocolVersion) adaptArgs(keyword string, args []arg) []arg {
+	switch keyword {
+	case "AGTLogon":
+		if !v.AtLeast(protocolVersionPCAPI) {
+			return args
+		}
+
+		adapted := make([]arg, len(args))
+		copy(adapted, args)
+		for i := range adapted {
+			if adapted[i].key == "version" {
+				adapted[i].value = "PCAPI_" + v.String()
+			}
+		}
+		return adapted
+	}
+
+	return args
+}
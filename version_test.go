@@ -0,0 +1,102 @@
+package apc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseProtocolVersion(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want ProtocolVersion
+	}{
+		{"5.1.0.0.4", ProtocolVersion{5, 1, 0, 0, 4}},
+		{"PCAPI_5.1.0.0.4", ProtocolVersion{5, 1, 0, 0, 4}},
+		{"5.2", ProtocolVersion{5, 2}},
+	} {
+		got, err := ParseProtocolVersion(tc.s)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseProtocolVersion(%q) = %v, %v, want %v", tc.s, got, err, tc.want)
+		}
+	}
+
+	for _, s := range []string{"", "5.x", "5.1.0.0.4.1", "-5"} {
+		if _, err := ParseProtocolVersion(s); err == nil {
+			t.Errorf("ParseProtocolVersion(%q) error = nil, want invalid version", s)
+		}
+	}
+}
+
+func TestProtocolVersion_AtLeast(t *testing.T) {
+	v := ProtocolVersion{5, 1, 0, 0, 4}
+	if !v.AtLeast(v) || !v.AtLeast(ProtocolVersion{5}) || !(ProtocolVersion{5, 2}).AtLeast(v) {
+		t.Error("AtLeast() = false for the same or an older version")
+	}
+	if v.AtLeast(ProtocolVersion{5, 1, 0, 0, 5}) || (ProtocolVersion{5, 0, 9}).AtLeast(v) {
+		t.Error("AtLeast() = true for a newer version")
+	}
+}
+
+func TestProtocolVersion_EncodeLogon(t *testing.T) {
+	args := []arg{newArg("agent_name", "agent"), newArg("password", "password"), newArg("version", "GOLANG_0.0.3")}
+
+	for _, tc := range []struct {
+		version ProtocolVersion
+		want    string
+	}{
+		{ProtocolVersion{}, "GOLANG_0.0.3"},
+		{ProtocolVersion{5, 0, 0, 0, 4}, "GOLANG_0.0.3"},
+		{ProtocolVersion{5, 2, 0, 0, 1}, "PCAPI_5.2.0.0.1"},
+	} {
+		adapted := tc.version.adaptArgs("AGTLogon", args)
+		values := make([]string, 0, len(adapted))
+		for _, a := range adapted {
+			values = append(values, a.value)
+		}
+
+		raw, err := encodeCommand("AGTLogon", 1, values...)
+		if err != nil {
+			t.Fatalf("encodeCommand() error = %v", err)
+		}
+		event, err := DecodeEvent(string(raw))
+		if err != nil {
+			t.Fatalf("DecodeEvent() error = %v", err)
+		}
+		if want := []string{"agent", "password", tc.want}; !reflect.DeepEqual(event.Segments, want) {
+			t.Errorf("AGTLogon for %v segments = %v, want %v", tc.version, event.Segments, want)
+		}
+	}
+
+	// Arguments of the caller aren't changed
+	if args[2].value != "GOLANG_0.0.3" {
+		t.Errorf("adaptArgs() has changed the arguments: %v", args)
+	}
+}
+
+func TestProtocolVersionOf(t *testing.T) {
+	info := ServerInfo{Name: "Agent server", Message: "AGENT_STARTUP", Extra: []string{"TLS", "PCAPI_5.2.0.0.1"}}
+	if got, want := protocolVersionOf(info), (ProtocolVersion{5, 2, 0, 0, 1}); got != want {
+		t.Errorf("protocolVersionOf() = %v, want %v", got, want)
+	}
+	if got := protocolVersionOf(ServerInfo{Message: "AGENT_STARTUP"}); !got.IsZero() {
+		t.Errorf("protocolVersionOf() = %v, want unknown version", got)
+	}
+}
+
+func TestClient_ProtocolVersion(t *testing.T) {
+	s := newMockServer(t, respondOK)
+	c, _ := newTestClient(t, s, WithProtocolVersion(ProtocolVersion{5, 1, 0, 0, 4}))
+
+	if got, want := c.ProtocolVersion(), (ProtocolVersion{5, 1, 0, 0, 4}); got != want {
+		t.Errorf("ProtocolVersion() = %v, want %v", got, want)
+	}
+	if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+		t.Fatalf("Logon() error = %v", err)
+	}
+
+	received := s.received()
+	if len(received) != 1 || !reflect.DeepEqual(received[0].Segments, []string{"agent", "password", "PCAPI_5.1.0.0.4"}) {
+		t.Errorf("server received %v, want AGTLogon with PCAPI_5.1.0.0.4", received)
+	}
+}
@@ -0,0 +1,46 @@
+package apc
+
+import (
+	"io"
+	"sync"
+)
+
+// wireLog writes every sent command and every received event frame to the writer, see WithWireLog.
+type wireLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// write writes the whole frame at once, so frames of both directions are never interleaved.
+func (l *wireLog) write(frame []byte) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, _ = l.w.Write(frame)
+}
+
+// ReplayReader decodes events from a stream recorded by WithWireLog, e.g. to reproduce decoding issues offline.
+// Sent commands are decoded as well, they have EventTypeCommand type.
+type ReplayReader struct {
+	frames *frameReader
+}
+
+// NewReplayReader returns ReplayReader of the recorded stream.
+func NewReplayReader(r io.Reader) *ReplayReader {
+	return &ReplayReader{frames: newFrameReader(r)}
+}
+
+// Next returns the next recorded event; it returns io.EOF at the end of the stream.
+// Unlike Client, it doesn't merge blocks of incomplete messages.
+func (r *ReplayReader) Next() (Event, error) {
+	raw, err := r.frames.next()
+	if err != nil {
+		return Event{}, err
+	}
+
+	return DecodeEvent(raw)
+}
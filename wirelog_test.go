@@ -0,0 +1,102 @@
+package apc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is bytes.Buffer safe for concurrent use
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+func TestWireLog_Replay(t *testing.T) {
+	s := newMockServer(t, func(conn *mockConn, cmd Event) {
+		if cmd.Keyword == "AGTListJobs" {
+			conn.data(cmd, "0", "M00001", "O,outbnd1,A", "I,inbnd1,A")
+		}
+		respondOK(conn, cmd)
+	})
+
+	var (
+		mu       sync.Mutex
+		received []Event
+	)
+	wire := &syncBuffer{}
+	c, done := newTestClient(t, s, WithWireLog(wire), WithRawEventHandler(func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		// The wire log has no arrival times
+		event.ReceivedAt = time.Time{}
+		received = append(received, event)
+	}))
+
+	if err := c.Logon(context.Background(), "agent", "password"); err != nil {
+		t.Fatalf("Logon() error = %v", err)
+	}
+	if _, err := c.ListJobs(context.Background(), JobTypeAll); err != nil {
+		t.Fatalf("ListJobs() error = %v", err)
+	}
+	// Let the handler get the last response: Logon, ListJobs data and ListJobs response
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n >= 3 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Stop()
+	_ = waitStart(t, done)
+
+	var commands, events []Event
+	replay := NewReplayReader(bytes.NewReader(wire.Bytes()))
+	for {
+		event, err := replay.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+
+		if event.Type == EventTypeCommand {
+			commands = append(commands, event)
+		} else {
+			events = append(events, event)
+		}
+	}
+
+	if got, want := commands, s.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed commands = %+v, want %+v", got, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// AGTSTART is received before the main event loop starts and is never passed to the handler
+	if len(events) == 0 || events[0].Keyword != "AGTSTART" {
+		t.Fatalf("replayed events = %+v, want AGTSTART first", events)
+	}
+	if got, want := events[1:], received; !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed events = %+v, want %+v", got, want)
+	}
+}